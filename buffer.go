@@ -1,44 +1,131 @@
 package spdy
 
-import "io"
+import (
+	"io"
+	"sync"
+)
 
-// buffer is a fixed size buffer that is used for receiving data on the
-// session rx thread.
-type buffer struct {
-	begin int
-	end   int
-	buf   [defaultBufferSize * 2]byte
+// Frames are received into pooled buffers which are handed from the rx
+// thread to the dispatch thread and, for DATA frames, on to the stream
+// without being copied. Most frames fit in the small buffers as that is the
+// most we send in a DATA frame.
+var (
+	rxSmallPool = sync.Pool{New: func() interface{} {
+		return new([maxDataPacketSize + 8]byte)
+	}}
+	rxLargePool = sync.Pool{New: func() interface{} {
+		return new([defaultBufferSize]byte)
+	}}
+)
+
+// getRxBuffer returns a buffer of length n. Only buffers of up to
+// defaultBufferSize are pooled.
+func getRxBuffer(n int) []byte {
+	switch {
+	case n <= maxDataPacketSize+8:
+		return rxSmallPool.Get().(*[maxDataPacketSize + 8]byte)[:n]
+	case n <= defaultBufferSize:
+		return rxLargePool.Get().(*[defaultBufferSize]byte)[:n]
+	}
+	return make([]byte, n)
+}
+
+// releaseRxBuffer returns a buffer from getRxBuffer to its pool.
+func releaseRxBuffer(d []byte) {
+	switch cap(d) {
+	case maxDataPacketSize + 8:
+		rxSmallPool.Put((*[maxDataPacketSize + 8]byte)(d[:cap(d)]))
+	case defaultBufferSize:
+		rxLargePool.Put((*[defaultBufferSize]byte)(d[:cap(d)]))
+	}
+}
+
+// rxChunk is a DATA payload along with the buffer it was received into.
+type rxChunk struct {
+	buf  []byte
+	data []byte
+}
+
+// rxQueue holds the data received on a stream until the user reads it. It
+// is guarded by the stream's rxLock.
+type rxQueue struct {
+	chunks []rxChunk
+	head   int // chunks before head have been read
+	length int
+}
+
+func (q *rxQueue) Len() int {
+	return q.length
 }
 
-func (s *buffer) Get(r io.Reader, n int) ([]byte, error) {
-	// compress the data we already have
-	if s.begin > defaultBufferSize {
-		copy(s.buf[:], s.buf[s.begin:s.end])
-		s.end -= s.begin
-		s.begin = 0
+// Push queues data which is a slice of the rx buffer buf. The queue takes
+// ownership of buf.
+//
+// Data that fits in the unused end of the last chunk's buffer is copied
+// there and buf is released straight away. Otherwise a remote sending tiny
+// frames could have us hold a whole buffer for each byte of its window. As
+// a new chunk is only started when the data doesn't fit in the last one,
+// at least half of the buffers held are data.
+func (q *rxQueue) Push(buf, data []byte) {
+	if len(data) == 0 {
+		releaseRxBuffer(buf)
+		return
 	}
 
-	toget := len(s.buf) - s.end
-	if toget > defaultBufferSize {
-		toget = defaultBufferSize
+	q.length += len(data)
+
+	if q.head < len(q.chunks) {
+		last := &q.chunks[len(q.chunks)-1]
+		if cap(last.data)-len(last.data) >= len(data) {
+			last.data = append(last.data, data...)
+			releaseRxBuffer(buf)
+			return
+		}
 	}
 
-	// only get up to the buffer size
-	if n > defaultBufferSize {
-		n = defaultBufferSize
+	q.chunks = append(q.chunks, rxChunk{buf, data})
+}
+
+// Read behaves as bytes.Buffer.Read, returning io.EOF once the queue is
+// empty.
+func (q *rxQueue) Read(p []byte) (int, error) {
+	if q.length == 0 {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
 	}
 
-	for s.end-s.begin < n {
-		got, err := r.Read(s.buf[s.end : s.end+toget])
-		s.end += got
-		if err != nil {
-			return nil, err
+	n := 0
+	for n < len(p) && q.head < len(q.chunks) {
+		c := &q.chunks[q.head]
+		got := copy(p[n:], c.data)
+		c.data = c.data[got:]
+		n += got
+
+		if len(c.data) == 0 {
+			releaseRxBuffer(c.buf)
+			*c = rxChunk{}
+			q.head++
 		}
 	}
 
-	return s.buf[s.begin : s.begin+n], nil
+	// Reuse the slice once it has all been read
+	if q.head == len(q.chunks) {
+		q.chunks = q.chunks[:0]
+		q.head = 0
+	}
+
+	q.length -= n
+	return n, nil
 }
 
-func (s *buffer) Flush(n int) {
-	s.begin += n
+// Reset drops any unread data.
+func (q *rxQueue) Reset() {
+	for _, c := range q.chunks[q.head:] {
+		releaseRxBuffer(c.buf)
+	}
+	q.chunks = nil
+	q.head = 0
+	q.length = 0
 }
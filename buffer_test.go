@@ -0,0 +1,109 @@
+package spdy
+
+import (
+	"io"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestRxQueue(t *testing.T) {
+	q := rxQueue{}
+
+	for _, s := range []string{"hello ", "", "spdy ", "world"} {
+		d := getRxBuffer(8 + len(s))
+		copy(d[8:], s)
+		q.Push(d, d[8:])
+	}
+
+	if q.Len() != 16 {
+		t.Fatalf("length %d", q.Len())
+	}
+
+	// Reads span chunks
+	buf := make([]byte, 4)
+	got := ""
+	for {
+		n, err := q.Read(buf)
+		got += string(buf[:n])
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got != "hello spdy world" || q.Len() != 0 {
+		t.Fatalf("read %q, %d left", got, q.Len())
+	}
+
+	if n, err := q.Read(nil); n != 0 || err != nil {
+		t.Fatalf("empty read %d %v", n, err)
+	}
+}
+
+func TestRxQueuePacksSmallFrames(t *testing.T) {
+	q := rxQueue{}
+	for i := 0; i < 1000; i++ {
+		d := getRxBuffer(9)
+		d[8] = byte(i)
+		q.Push(d, d[8:])
+	}
+
+	// The bytes are packed into the first buffer
+	if len(q.chunks) != 1 || q.Len() != 1000 {
+		t.Fatalf("%d bytes in %d chunks", q.Len(), len(q.chunks))
+	}
+
+	buf := make([]byte, 2000)
+	if n, _ := q.Read(buf); n != 1000 {
+		t.Fatalf("read %d", n)
+	}
+	for i, b := range buf[:1000] {
+		if b != byte(i) {
+			t.Fatalf("byte %d is %d", i, b)
+		}
+	}
+}
+
+func heapInUse() uint64 {
+	var m runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&m)
+	return m.HeapInuse
+}
+
+func TestTinyDataFrames(t *testing.T) {
+	peer, s := openRawPeer(t, func(c *Connection) {})
+	const frames = 16000
+
+	before := heapInUse()
+
+	// The PING reply comes back once all of the DATA has been handled
+	go func() {
+		for i := 0; i < frames; i++ {
+			(&dataFrame{StreamId: 1, Data: []byte{byte(i)}}).WriteFrame(peer, nil)
+		}
+		(&pingFrame{Version: 3, Id: 1}).WriteFrame(peer, nil)
+	}()
+
+	peer.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := parsePing(readFrame(t, peer)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each 1 byte frame would otherwise hold a 4KB buffer, 64MB in all
+	if grown := int64(heapInUse()) - int64(before); grown > 1<<20 {
+		t.Fatalf("heap grew by %d bytes for %d bytes of data", grown, frames)
+	}
+
+	buf := make([]byte, frames)
+	if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatal(err)
+	}
+	for i, b := range buf {
+		if b != byte(i) {
+			t.Fatalf("byte %d is %d", i, b)
+		}
+	}
+}
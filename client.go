@@ -2,7 +2,11 @@ package spdy
 
 import (
 	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
@@ -10,8 +14,10 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"path"
 	"strings"
 	"sync"
+	"time"
 )
 
 var DefaultTransport http.RoundTripper = &Transport{
@@ -22,7 +28,28 @@ var DefaultTransport http.RoundTripper = &Transport{
 var DefaultClient = &http.Client{Transport: DefaultTransport}
 
 // requestTxThread pushes the request body down the stream
-func requestTxThread(body io.ReadCloser, s *stream, compressed bool) {
+func requestTxThread(body io.ReadCloser, s *stream, compressed bool, cont chan bool, timeout time.Duration) {
+	// Hold back the body until the server asks for it, or until we give
+	// up waiting and send it anyway. If the final response arrives first
+	// then the server doesn't want the body.
+	if cont != nil {
+		timer := time.NewTimer(timeout)
+		select {
+		case <-cont:
+		case <-timer.C:
+		}
+		timer.Stop()
+
+		s.rxLock.Lock()
+		skip := !s.rxContinued && (s.rxResponse != nil || s.rxError != nil)
+		s.rxLock.Unlock()
+
+		if skip {
+			body.Close()
+			return
+		}
+	}
+
 	// io.Copy uses large Reads so buffering is not needed
 	tx := (*streamTxUser)(s)
 	tx.EnableOutputBuffering(false)
@@ -41,27 +68,48 @@ func (c *Connection) startRequest(parent *stream, req *http.Request, extra *Requ
 		extra = DefaultExtra
 	}
 
-	txFinished := req.Body == nil
+	// CONNECT requests without a body leave the stream open so that the
+	// response body can be written to.
+	tunnel := req.Method == "CONNECT" && req.Body == nil
+
+	txFinished := req.Body == nil && !tunnel
 	body := req.Body
 	req.Body = nil
 
 	s := c.newStream(req, txFinished, extra)
 	s.parent = parent
 
-	// Send the SYN_REQUEST
+	if tunnel {
+		s.txBuffered = false
+	}
+
+	timeout := extra.ExpectContinueTimeout
+	if timeout == 0 {
+		timeout = DefaultExpectContinueTimeout
+	}
+
+	if body != nil && timeout > 0 && expectsContinue(req.Header) {
+		s.rxContinue = make(chan bool)
+	}
+	cont := s.rxContinue
+
+	// Send the SYN_REQUEST. If the stream isn't started the body is put
+	// back so that the request can be sent again.
 	select {
 	case <-c.onGoAway:
+		req.Body = body
 		return nil, ErrGoAway
 	case c.onStartRequest <- s:
 	}
 
 	if err := <-c.onRequestStarted; err != nil {
+		req.Body = body
 		return nil, err
 	}
 
 	// Start the request body push
-	if !txFinished {
-		go requestTxThread(body, s, extra.Compressed)
+	if body != nil {
+		go requestTxThread(body, s, extra.Compressed, cont, timeout)
 	}
 
 	// Wait for the reply
@@ -76,6 +124,10 @@ func (c *Connection) startRequest(parent *stream, req *http.Request, extra *Requ
 		s.rxCond.Wait()
 	}
 
+	if tunnel && s.rxResponse != nil {
+		s.rxResponse.Body = (*streamConn)(s)
+	}
+
 	return s.rxResponse, s.rxError
 }
 
@@ -84,10 +136,108 @@ type Transport struct {
 	Dial            func(net, addr string) (c net.Conn, err error)
 	TLSClientConfig *tls.Config
 	FallbackClient  *http.Client
-	RequestExtra    *RequestExtra
+
+	// RequestExtra sets the stream options for requests. Requests with an
+	// "Expect: 100-continue" header wait for ExpectContinueTimeout before
+	// sending the body to servers other than this package's, see
+	// RequestExtra.ExpectContinueTimeout.
+	RequestExtra *RequestExtra
+
+	// ServerRequestHandler handles requests that the server starts on
+	// connections to it, outside of any pushed stream. Servers get the
+	// connection with ConnectionFromRequest and then use its RoundTrip.
+	// If nil such requests are refused.
+	ServerRequestHandler http.Handler
+
+	// ReceiveWindow is the initial per stream flow control window
+	// announced to servers. Zero uses the SPDY default of 64KB.
+	ReceiveWindow int
+
+	// AutoTuneBudget enables stream receive window auto-tuning, see
+	// Connection.SetAutoTuneBudget.
+	AutoTuneBudget int
+
+	// MaxControlFrameSize limits the control frames accepted from
+	// servers, see Connection.SetMaxControlFrameSize. Zero uses
+	// DefaultMaxControlFrameSize.
+	MaxControlFrameSize int
+
+	// HeaderCompression is the zlib compression level for the headers
+	// sent to servers. Zero uses the default of zlib.BestCompression, so
+	// set DisableHeaderCompression for zlib.NoCompression.
+	HeaderCompression int
+
+	// DisableHeaderCompression sends the headers uncompressed, in zlib
+	// stored blocks. It takes precedence over HeaderCompression.
+	DisableHeaderCompression bool
+
+	// SensitiveHeaders are kept out of the header compression context,
+	// see Connection.SetSensitiveHeaders. Nil uses
+	// DefaultSensitiveHeaders.
+	SensitiveHeaders []string
+
+	// RateLimits limits the frames accepted from servers, see
+	// Connection.SetRateLimits. Nil uses DefaultRateLimits.
+	RateLimits *RateLimits
+
+	// DialContext is used to make TCP connections and takes precedence
+	// over Dial. If neither is set then a net.Dialer is used, which races
+	// IPv4 and IPv6 addresses with DialTimeout and FallbackDelay as its
+	// Timeout and FallbackDelay.
+	DialContext   func(ctx context.Context, network, addr string) (net.Conn, error)
+	DialTimeout   time.Duration
+	FallbackDelay time.Duration
+
+	// TLSHandshakeTimeout limits the time spent on TLS handshakes with
+	// origins and proxies. Zero means no limit beyond the request context.
+	TLSHandshakeTimeout time.Duration
+
+	// ProxyConnectHeader is sent with every CONNECT request to a proxy.
+	ProxyConnectHeader http.Header
+
+	// GetProxyConnectHeader, if set, is called for each CONNECT request
+	// to get extra headers (eg tokens) to send to the proxy. target is
+	// the host:port being tunnelled to.
+	GetProxyConnectHeader func(proxy *url.URL, target string) (http.Header, error)
+
+	// CleartextVersion, if non-zero, is the SPDY version to speak over
+	// plain TCP to http:// URLs instead of using FallbackClient. This
+	// requires prior knowledge that the server speaks SPDY (eg it was
+	// started with ListenAndServe). If CleartextHosts is non-empty then
+	// only hosts matching one of the patterns (as per path.Match, eg
+	// "*.internal") use SPDY.
+	CleartextVersion int
+	CleartextHosts   []string
+
+	// DisableCompression stops the transport from asking for gzipped
+	// responses. Otherwise, if the request doesn't have its own
+	// Accept-Encoding, gzip is requested and gzip or deflate encoded
+	// responses are transparently decompressed. Decompressed responses
+	// have Uncompressed set and no Content-Length.
+	DisableCompression bool
+
+	// MaxRetries is the number of times a request is sent again on a new
+	// connection after the server refuses it without processing it, either
+	// by a GO_AWAY with a lower last stream id or by a REFUSED_STREAM reset.
+	// Zero uses DefaultMaxRetries and a negative value disables retries.
+	// Requests with a body can only be retried if GetBody is set.
+	MaxRetries int
+
+	// RetryPolicy, if set, is called before each retry with the error and
+	// the number of retries so far. Returning false stops retrying and
+	// returns the error from RoundTrip.
+	RetryPolicy func(req *http.Request, err error, retries int) bool
+
+	// SpdyProxy enables offering SPDY to https proxies. If the proxy
+	// negotiates SPDY then requests for all origins, including http ones,
+	// are sent as streams on a single session with the proxy instead of
+	// through a CONNECT tunnel per origin.
+	SpdyProxy bool
 
 	lk          sync.Mutex
-	connections map[string]*Connection // key is proxy_url|host:port
+	connections map[string]*Connection // key is proxy_url|scheme://host:port
+	httpProxies map[string]bool        // https proxies which don't speak spdy
+	dialing     map[string]*dialCall   // dials in progress by connection key
 }
 
 // Given a string of the form "host", "host:port", or "[ipv6::address]:port",
@@ -110,46 +260,119 @@ func removePort(s string) string {
 	return s[:strings.LastIndex(s, ":")]
 }
 
+// connKey returns the connection cache key. Requests sent directly over a
+// SPDY session with a proxy have a nil req and are keyed by proxy only.
 func connKey(proxy *url.URL, req *http.Request) string {
 	proxyStr := ""
 	if proxy != nil {
 		proxyStr = proxy.String()
 	}
-	hostStr := addDefaultPort(req.URL.Host, 443)
+	hostStr := ""
+	if req != nil {
+		hostStr = req.URL.Scheme + "://" + originAddr(req.URL)
+	}
 	return strings.Join([]string{proxyStr, hostStr}, "|")
 }
 
-func (t *Transport) dialProxy(proxy *url.URL, addr string) (net.Conn, error) {
-	dial := t.Dial
-	if dial == nil {
-		dial = net.Dial
+// originAddr returns the host:port to connect to for u.
+func originAddr(u *url.URL) string {
+	if u.Scheme == "http" {
+		return addDefaultPort(u.Host, 80)
 	}
-	addr = addDefaultPort(addr, 443)
-	addrUrl, err := url.Parse(addr)
-	if err != nil {
-		return nil, err
+	return addDefaultPort(u.Host, 443)
+}
+
+// cleartextVersion returns the SPDY version to speak over plain TCP to
+// host or 0 if the fallback client should be used.
+func (t *Transport) cleartextVersion(host string) int {
+	if t.CleartextVersion == 0 {
+		return 0
 	}
 
+	if len(t.CleartextHosts) == 0 {
+		return t.CleartextVersion
+	}
+
+	host = removePort(host)
+	for _, pattern := range t.CleartextHosts {
+		if ok, _ := path.Match(pattern, host); ok {
+			return t.CleartextVersion
+		}
+	}
+
+	return 0
+}
+
+// dial makes a TCP connection using DialContext, Dial or a default dialer in
+// that order.
+func (t *Transport) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if t.DialContext != nil {
+		return t.DialContext(ctx, network, addr)
+	}
+
+	if t.Dial != nil {
+		return t.Dial(network, addr)
+	}
+
+	d := net.Dialer{
+		Timeout:       t.DialTimeout,
+		FallbackDelay: t.FallbackDelay,
+		KeepAlive:     30 * time.Second,
+	}
+	return d.DialContext(ctx, network, addr)
+}
+
+// dialProxy connects to addr (host:port) through proxy if non-nil.
+func (t *Transport) dialProxy(ctx context.Context, proxy *url.URL, addr string) (net.Conn, error) {
+	addrUrl := &url.URL{Opaque: addr}
+
 	if proxy == nil {
-		return dial("tcp", addr)
+		return t.dial(ctx, "tcp", addr)
 	}
 
-	if proxy.Scheme != "http" {
+	var conn net.Conn
+	var err error
+
+	switch proxy.Scheme {
+	case "http":
+		conn, err = t.dial(ctx, "tcp", addDefaultPort(proxy.Host, 80))
+	case "https":
+		conn, err = t.dialTLSProxy(ctx, proxy, nil)
+	case "socks5":
+		conn, err = t.dial(ctx, "tcp", addDefaultPort(proxy.Host, 1080))
+	default:
 		return nil, ErrUnsupportedProxy(proxy.Scheme)
 	}
 
-	conn, err := dial("tcp", addDefaultPort(proxy.Host, 80))
 	if err != nil {
 		return nil, err
 	}
 
+	// Limit the proxy handshake to the request deadline
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	if proxy.Scheme == "socks5" {
+		if err := socksConnectTo(conn, proxy, addr); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+
 	req := &http.Request{
 		Method: "CONNECT",
 		URL:    addrUrl,
 		Host:   addr,
 		Header: make(http.Header),
 	}
-	// TODO(james): Proxy-Authentication
+
+	if err := t.setProxyHeader(req, proxy); err != nil {
+		conn.Close()
+		return nil, err
+	}
 
 	if err := req.Write(conn); err != nil {
 		conn.Close()
@@ -165,6 +388,13 @@ func (t *Transport) dialProxy(proxy *url.URL, addr string) (net.Conn, error) {
 		conn.Close()
 		return nil, err
 	}
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		conn.Close()
+		return nil, &ErrProxyAuthRequired{
+			Proxy:     proxy.Host,
+			Challenge: resp.Header["Proxy-Authenticate"],
+		}
+	}
 	if resp.StatusCode != 200 {
 		f := strings.SplitN(resp.Status, " ", 2)
 		conn.Close()
@@ -174,8 +404,478 @@ func (t *Transport) dialProxy(proxy *url.URL, addr string) (net.Conn, error) {
 	return conn, nil
 }
 
-func (t *Transport) runClient(key string, c *Connection) {
-	c.Run()
+// dialTLSProxy connects to a HTTPS proxy. The TLS connection to the proxy is
+// verified against the proxy's host name using TLSClientConfig.
+func (t *Transport) dialTLSProxy(ctx context.Context, proxy *url.URL, nextProtos []string) (*tls.Conn, error) {
+	conn, err := t.dial(ctx, "tcp", addDefaultPort(proxy.Host, 443))
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{}
+	if t.TLSClientConfig != nil {
+		cfg = t.TLSClientConfig.Clone()
+	}
+	cfg.ServerName = removePort(proxy.Host)
+	cfg.NextProtos = nextProtos
+
+	tlsConn := tls.Client(conn, cfg)
+	if err := t.handshake(ctx, tlsConn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+// setProxyHeader adds the proxy connect headers and any credentials in the
+// proxy URL to a CONNECT request. Explicitly provided headers take precedence
+// over the URL credentials.
+func (t *Transport) setProxyHeader(req *http.Request, proxy *url.URL) error {
+	for key, vals := range t.ProxyConnectHeader {
+		req.Header[key] = append([]string(nil), vals...)
+	}
+
+	if t.GetProxyConnectHeader != nil {
+		h, err := t.GetProxyConnectHeader(proxy, req.Host)
+		if err != nil {
+			return err
+		}
+		for key, vals := range h {
+			req.Header[key] = append([]string(nil), vals...)
+		}
+	}
+
+	if proxy.User != nil && req.Header.Get("Proxy-Authorization") == "" {
+		req.Header.Set("Proxy-Authorization", basicAuth(proxy.User))
+	}
+
+	return nil
+}
+
+func basicAuth(user *url.Userinfo) string {
+	pass, _ := user.Password()
+	auth := user.Username() + ":" + pass
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(auth))
+}
+
+var (
+	errNotSpdyProxy = errors.New("spdy: proxy does not support spdy")
+	errNotSpdy      = errors.New("spdy: server does not support spdy")
+)
+
+// dialCall is a connection dial in progress. Other requests for the same
+// connection key wait on done rather than starting their own dial.
+type dialCall struct {
+	done    chan bool
+	c       *Connection
+	err     error
+	closing bool // CloseAllConnections was called, so c isn't cached
+}
+
+// retryDial returns whether a request waiting on another request's failed
+// dial should try again with its own dial. This is the case when the failure
+// was specific to the first request.
+func retryDial(err error) bool {
+	return err == errNotSpdy ||
+		errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
+
+// getConnection returns the cached connection for key or calls dial to create
+// a new one. The transport lock is not held whilst dialling so that a slow
+// host doesn't hold up requests to other hosts. Only one dial per key is in
+// progress at a time, other requests wait for it to finish.
+func (t *Transport) getConnection(ctx context.Context, key string, dial func() (*Connection, error)) (*Connection, error) {
+	for {
+		t.lk.Lock()
+		c := t.connections[key]
+		call := t.dialing[key]
+
+		if c == nil && call == nil {
+			call = &dialCall{done: make(chan bool)}
+			if t.dialing == nil {
+				t.dialing = make(map[string]*dialCall)
+			}
+			t.dialing[key] = call
+			t.lk.Unlock()
+
+			call.c, call.err = dial()
+
+			t.lk.Lock()
+			delete(t.dialing, key)
+			if call.c != nil && !call.closing {
+				if t.connections == nil {
+					t.connections = make(map[string]*Connection)
+				}
+				t.connections[key] = call.c
+			}
+			if call.c != nil {
+				go t.runClient(key, call.c)
+			}
+			t.lk.Unlock()
+
+			close(call.done)
+			return call.c, call.err
+		}
+
+		t.lk.Unlock()
+
+		if c != nil {
+			return c, nil
+		}
+
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		if call.c != nil {
+			return call.c, nil
+		} else if !retryDial(call.err) {
+			return nil, call.err
+		}
+	}
+}
+
+// DefaultMaxRetries is the number of retries used when Transport.MaxRetries
+// is zero.
+const DefaultMaxRetries = 3
+
+// unprocessed returns whether err means that the server never processed the
+// request and thus that it is safe to send it again.
+func unprocessed(err error) bool {
+	_, refused := err.(ErrRefusedStream)
+	return refused || err == ErrGoAway
+}
+
+// nextAttempt returns the request to send after prev was refused with err,
+// or nil if it should not be retried.
+func (t *Transport) nextAttempt(req, prev *http.Request, err error, retries int) *http.Request {
+	max := t.MaxRetries
+	if max == 0 {
+		max = DefaultMaxRetries
+	}
+
+	if retries >= max {
+		return nil
+	}
+
+	if t.RetryPolicy != nil && !t.RetryPolicy(req, err, retries) {
+		return nil
+	}
+
+	next := *req
+
+	switch {
+	case prev.Body != nil:
+		// The stream was never started so the body is untouched
+		next.Body = prev.Body
+	case req.Body == nil || req.Body == http.NoBody:
+	case req.GetBody != nil:
+		body, err := req.GetBody()
+		if err != nil {
+			return nil
+		}
+		next.Body = body
+	default:
+		return nil
+	}
+
+	return &next
+}
+
+// sendRequest sends req on the connection for key, calling dial to create
+// it if needed. Requests that the server refuses without processing are
+// sent again on a new connection as per MaxRetries and RetryPolicy.
+func (t *Transport) sendRequest(req *http.Request, key string, dial func() (*Connection, error)) (*http.Response, error) {
+	out := *req
+	decode := t.requestCompression(&out)
+
+	for retries := 0; ; retries++ {
+		c, err := t.getConnection(req.Context(), key, dial)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := c.startRequest(nil, &out, t.RequestExtra)
+		if resp != nil {
+			resp.Request = req
+			if decode {
+				decodeResponse(resp)
+			}
+		}
+
+		if !unprocessed(err) {
+			return resp, err
+		}
+
+		// In the case that we were told to go away or the stream
+		// was refused, the connection is finished with and we need
+		// to reconnect. ErrGoAway also covers startRequest going
+		// through after the socket has already been closed due to an
+		// error or timeout.
+		t.removeConnection(key, c)
+		if err != ErrGoAway {
+			c.GoAway()
+		}
+
+		next := t.nextAttempt(req, &out, err, retries)
+		if next == nil {
+			if out.Body != nil {
+				out.Body.Close()
+			}
+			return nil, err
+		}
+
+		header := out.Header
+		out = *next
+		out.Header = header
+	}
+}
+
+// requestCompression asks for a gzipped response by adding an
+// Accept-Encoding header to req, unless compression is disabled or the caller
+// has already chosen an encoding. It returns whether the response should be
+// decoded.
+func (t *Transport) requestCompression(req *http.Request) bool {
+	if t.DisableCompression ||
+		req.Method == "HEAD" ||
+		req.Method == "CONNECT" ||
+		req.Header.Get("Accept-Encoding") != "" ||
+		req.Header.Get("Range") != "" {
+		return false
+	}
+
+	req.Header = req.Header.Clone()
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	return true
+}
+
+// decodeResponse transparently decompresses gzip and deflate encoded response
+// bodies.
+func decodeResponse(resp *http.Response) {
+	var newReader func(io.Reader) (io.Reader, error)
+
+	switch strings.ToLower(resp.Header.Get("Content-Encoding")) {
+	case "gzip":
+		newReader = func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }
+	case "deflate":
+		newReader = func(r io.Reader) (io.Reader, error) { return zlib.NewReader(r) }
+	default:
+		return
+	}
+
+	resp.Body = &decodedBody{body: resp.Body, newReader: newReader}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+}
+
+// decodedBody decompresses the response body. The decompressor is created on
+// the first read as it blocks reading the stream header.
+type decodedBody struct {
+	body      io.ReadCloser
+	newReader func(io.Reader) (io.Reader, error)
+	r         io.Reader
+	err       error
+}
+
+func (s *decodedBody) Read(p []byte) (int, error) {
+	if s.r == nil && s.err == nil {
+		s.r, s.err = s.newReader(s.body)
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+	return s.r.Read(p)
+}
+
+func (s *decodedBody) Close() error {
+	return s.body.Close()
+}
+
+// roundTripSpdyProxy sends req as a stream on a SPDY session with an https
+// proxy. All origins share the one session, with the full URL sent in the
+// SYN_STREAM. If the proxy doesn't negotiate SPDY then errNotSpdyProxy is
+// returned and the request should be tunnelled instead.
+func (t *Transport) roundTripSpdyProxy(proxy *url.URL, req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	key := connKey(proxy, nil)
+
+	preq := *req
+	preq.Header = req.Header.Clone()
+	if proxy.User != nil && preq.Header.Get("Proxy-Authorization") == "" {
+		preq.Header.Set("Proxy-Authorization", basicAuth(proxy.User))
+	}
+
+	t.lk.Lock()
+	httpOnly := t.httpProxies[key]
+	t.lk.Unlock()
+
+	if httpOnly {
+		return nil, errNotSpdyProxy
+	}
+
+	resp, err := t.sendRequest(&preq, key, func() (*Connection, error) {
+		return t.dialSpdyProxy(ctx, key, proxy)
+	})
+
+	if resp != nil {
+		resp.Request = req
+	}
+
+	return resp, err
+}
+
+// newConnection sets up a client connection with the transport's settings.
+func (t *Transport) newConnection(sock net.Conn, version int) *Connection {
+	c := NewConnection(sock, t.ServerRequestHandler, version, false)
+	if t.ReceiveWindow > 0 {
+		c.SetReceiveWindow(t.ReceiveWindow)
+	}
+	c.SetAutoTuneBudget(t.AutoTuneBudget)
+	if t.MaxControlFrameSize > 0 {
+		c.SetMaxControlFrameSize(t.MaxControlFrameSize)
+	}
+	if t.DisableHeaderCompression {
+		c.SetHeaderCompression(zlib.NoCompression)
+	} else if t.HeaderCompression != 0 {
+		c.SetHeaderCompression(t.HeaderCompression)
+	}
+	if t.SensitiveHeaders != nil {
+		c.SetSensitiveHeaders(t.SensitiveHeaders)
+	}
+	if t.RateLimits != nil {
+		c.SetRateLimits(*t.RateLimits)
+	}
+	return c
+}
+
+// dialSpdyProxy starts a SPDY session with an https proxy.
+func (t *Transport) dialSpdyProxy(ctx context.Context, key string, proxy *url.URL) (*Connection, error) {
+	sock, err := t.dialTLSProxy(ctx, proxy, []string{"spdy/3", "spdy/2", "http/1.1"})
+	if err != nil {
+		return nil, err
+	}
+
+	switch sock.ConnectionState().NegotiatedProtocol {
+	case "spdy/2":
+		return t.newConnection(sock, 2), nil
+	case "spdy/3":
+		return t.newConnection(sock, 3), nil
+	}
+
+	// Remember that the proxy only speaks HTTP so we go straight to
+	// tunnelling next time.
+	sock.Close()
+	t.lk.Lock()
+	if t.httpProxies == nil {
+		t.httpProxies = make(map[string]bool)
+	}
+	t.httpProxies[key] = true
+	t.lk.Unlock()
+	return nil, errNotSpdyProxy
+}
+
+// dialConnection connects to the origin of req. If the origin doesn't
+// negotiate SPDY then the TLS socket is returned instead so that the request
+// can be sent using HTTP/1.1.
+func (t *Transport) dialConnection(ctx context.Context, proxy *url.URL, req *http.Request, cleartext int) (*Connection, *tls.Conn, error) {
+	sock, err := t.dialProxy(ctx, proxy, originAddr(req.URL))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if cleartext != 0 {
+		return t.newConnection(sock, cleartext), nil, nil
+	}
+
+	cfg := &tls.Config{}
+	if t.TLSClientConfig != nil {
+		cfg = t.TLSClientConfig.Clone()
+	}
+
+	cfg.NextProtos = []string{"http/1.1", "spdy/3", "spdy/2"}
+	cfg.ServerName = removePort(req.URL.Host)
+
+	tlsSock := tls.Client(sock, cfg)
+	if err := t.handshake(ctx, tlsSock); err != nil {
+		sock.Close()
+		return nil, nil, err
+	}
+
+	if err := tlsSock.VerifyHostname(cfg.ServerName); err != nil {
+		tlsSock.Close()
+		return nil, nil, err
+	}
+
+	switch tlsSock.ConnectionState().NegotiatedProtocol {
+	case "", "http/1.1":
+		return nil, tlsSock, nil
+	case "spdy/2":
+		return t.newConnection(tlsSock, 2), nil, nil
+	case "spdy/3":
+		return t.newConnection(tlsSock, 3), nil, nil
+	}
+
+	panic("spdy-internal: unexpected negotiated protocol")
+}
+
+// handshake runs the TLS handshake limited by TLSHandshakeTimeout.
+func (t *Transport) handshake(ctx context.Context, sock *tls.Conn) error {
+	if t.TLSHandshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.TLSHandshakeTimeout)
+		defer cancel()
+	}
+	return sock.HandshakeContext(ctx)
+}
+
+// roundTripHTTP sends req using HTTP/1.1 over sock, for origins that don't
+// speak SPDY.
+func (t *Transport) roundTripHTTP(sock *tls.Conn, req *http.Request) (*http.Response, error) {
+	out := *req
+	decode := t.requestCompression(&out)
+
+	client := httputil.NewClientConn(sock, nil)
+	resp, err := client.Do(&out)
+	if err != nil {
+		client.Close()
+		sock.Close()
+		return nil, err
+	}
+
+	// The connection is closed once the body is read
+	resp.Body = &fallbackBody{resp.Body, sock}
+	resp.Request = req
+	if decode {
+		decodeResponse(resp)
+	}
+	return resp, nil
+}
+
+// fallbackBody closes the socket of a HTTPS fallback request once the
+// response body is closed.
+type fallbackBody struct {
+	io.ReadCloser
+	sock net.Conn
+}
+
+func (b *fallbackBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.sock.Close()
+	return err
+}
+
+// removeConnection removes c from the connection cache so that new requests
+// start a new connection.
+func (t *Transport) removeConnection(key string, c *Connection) {
 	t.lk.Lock()
 	if t.connections[key] == c {
 		delete(t.connections, key)
@@ -183,6 +883,17 @@ func (t *Transport) runClient(key string, c *Connection) {
 	t.lk.Unlock()
 }
 
+func (t *Transport) runClient(key string, c *Connection) {
+	c.Run()
+	t.removeConnection(key, c)
+}
+
+// RoundTrip sends req over a SPDY connection where possible.
+//
+// CONNECT requests are sent to the server in the URL asking it to tunnel to
+// req.Host. If the request has no body then the response body is also
+// writable (an io.ReadWriteCloser with CloseWrite) and carries both sides of
+// the tunnel.
 func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
 	if req.URL == nil {
 		return nil, errors.New("http: nil Request.URL")
@@ -191,7 +902,26 @@ func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error
 		return nil, errors.New("http: nil Request.Header")
 	}
 
-	if req.URL.Scheme != "https" {
+	var proxy *url.URL
+	if t.Proxy != nil {
+		if proxy, err = t.Proxy(req); err != nil {
+			return nil, err
+		}
+	}
+
+	if t.SpdyProxy && proxy != nil && proxy.Scheme == "https" {
+		resp, err := t.roundTripSpdyProxy(proxy, req)
+		if err != errNotSpdyProxy {
+			return resp, err
+		}
+	}
+
+	cleartext := 0
+	if req.URL.Scheme == "http" {
+		cleartext = t.cleartextVersion(req.URL.Host)
+	}
+
+	if req.URL.Scheme != "https" && cleartext == 0 {
 		if t.FallbackClient == nil {
 			return nil, errors.New(fmt.Sprintf("spdy: no fallback client for scheme %s", req.URL.Scheme))
 		}
@@ -199,86 +929,158 @@ func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error
 		return t.FallbackClient.Do(req)
 	}
 
-	var proxy *url.URL
-	if t.Proxy != nil {
-		if proxy, err = t.Proxy(req); err != nil {
-			return nil, err
+	ctx := req.Context()
+	key := connKey(proxy, req)
+
+	// CONNECT requests are sent to the server given by the URL asking it
+	// to tunnel to Host.
+	out := req
+	if req.Method == "CONNECT" && req.Host != "" {
+		connect := *req
+		connect.URL = &url.URL{Host: req.Host}
+		out = &connect
+	}
+
+	var sock *tls.Conn
+
+	resp, err = t.sendRequest(out, key, func() (*Connection, error) {
+		c, s, err := t.dialConnection(ctx, proxy, req, cleartext)
+		if s != nil {
+			sock = s
+			return nil, errNotSpdy
 		}
+		return c, err
+	})
+
+	if err == errNotSpdy {
+		// fallback to a standard HTTPS client
+		return t.roundTripHTTP(sock, req)
 	}
 
-	key := connKey(proxy, req)
+	if resp != nil {
+		resp.Request = req
+	}
 
-reconnect:
+	return resp, err
+}
+
+// ConnectionInfo describes a connection cached by a Transport.
+type ConnectionInfo struct {
+	Origin     string // scheme://host:port of the origin, empty for a proxy session
+	Proxy      string // proxy URL or empty if connected directly
+	Version    int
+	NumStreams int
+}
+
+// Connections returns information on the currently cached connections.
+func (t *Transport) Connections() []ConnectionInfo {
 	t.lk.Lock()
-	c := t.connections[key]
+	keys := make([]string, 0, len(t.connections))
+	conns := make([]*Connection, 0, len(t.connections))
+	for key, c := range t.connections {
+		keys = append(keys, key)
+		conns = append(conns, c)
+	}
+	t.lk.Unlock()
 
-	// Try and use an existing connection
-	if c == nil {
-		proxySock, err := t.dialProxy(proxy, req.URL.Host)
-		if err != nil {
-			t.lk.Unlock()
-			return nil, err
+	ret := make([]ConnectionInfo, len(conns))
+	for i, c := range conns {
+		split := strings.SplitN(keys[i], "|", 2)
+		proxy := split[0]
+		if u, err := url.Parse(proxy); err == nil && u.User != nil {
+			// Don't leak the proxy credentials
+			proxy = u.Redacted()
 		}
-
-		cfg := tls.Config{}
-		if t.TLSClientConfig != nil {
-			cfg = *t.TLSClientConfig
+		ret[i] = ConnectionInfo{
+			Origin:     split[1],
+			Proxy:      proxy,
+			Version:    c.Version(),
+			NumStreams: c.NumStreams(),
 		}
+	}
 
-		cfg.NextProtos = []string{"http/1.1", "spdy/3", "spdy/2"}
-		cfg.ServerName = removePort(req.URL.Host)
+	return ret
+}
 
-		tlsSock := tls.Client(proxySock, &cfg)
-		if err := tlsSock.Handshake(); err != nil {
-			t.lk.Unlock()
-			tlsSock.Close()
-			proxySock.Close()
-			return nil, err
-		}
+// CloseIdleConnections sends a GO_AWAY to and closes any cached connections
+// which currently have no active streams. Connections with active streams
+// are left alone. It also closes the idle connections of the fallback client.
+func (t *Transport) CloseIdleConnections() {
+	t.lk.Lock()
+	conns := make(map[string]*Connection)
+	for key, c := range t.connections {
+		conns[key] = c
+	}
+	t.lk.Unlock()
 
-		if err := tlsSock.VerifyHostname(cfg.ServerName); err != nil {
-			t.lk.Unlock()
-			tlsSock.Close()
-			proxySock.Close()
-			return nil, err
+	for key, c := range conns {
+		if c.CloseIfIdle() {
+			t.removeConnection(key, c)
 		}
+	}
 
-		switch tlsSock.ConnectionState().NegotiatedProtocol {
-		case "http/1.1":
-			// fallback to a standard HTTPS client
-			t.lk.Unlock()
-			client := httputil.NewClientConn(tlsSock, nil)
-			resp, err := client.Do(req)
-			client.Close()
-			tlsSock.Close()
-			proxySock.Close()
-			return resp, err
-
-		case "spdy/2":
-			c = NewConnection(tlsSock, nil, 2, false)
-		case "spdy/3":
-			c = NewConnection(tlsSock, nil, 3, false)
-		default:
-			panic("spdy-internal: unexpected negotiated protocol")
-		}
+	if t.FallbackClient != nil {
+		t.FallbackClient.CloseIdleConnections()
+	}
+}
 
-		if t.connections == nil {
-			t.connections = make(map[string]*Connection)
-		}
-		t.connections[key] = c
-		go t.runClient(key, c)
+// CloseAllConnections sends a GO_AWAY to all of the cached connections and
+// waits for their active streams to finish. Connections that are still being
+// dialled are waited for and shut down in the same way. If ctx is done before
+// then, the remaining connections are closed immediately and the context's
+// error is returned.
+func (t *Transport) CloseAllConnections(ctx context.Context) error {
+	t.lk.Lock()
+	conns := make([]*Connection, 0, len(t.connections))
+	for _, c := range t.connections {
+		conns = append(conns, c)
 	}
+	t.connections = nil
 
+	calls := make([]*dialCall, 0, len(t.dialing))
+	for _, call := range t.dialing {
+		call.closing = true
+		calls = append(calls, call)
+	}
 	t.lk.Unlock()
-	resp, err = c.startRequest(nil, req, t.RequestExtra)
 
-	// In the case that we missed the connection due to being told to go
-	// away, we need to reconnect. This is due to either the server
-	// sending us a GO_AWAY or the startRequest going through after the
-	// socket has already been closed due to an error or timeout.
-	if err == ErrGoAway {
-		goto reconnect
+	for _, c := range conns {
+		c.GoAway()
 	}
 
-	return resp, err
+	for i, call := range calls {
+		select {
+		case <-call.done:
+			if call.c != nil {
+				call.c.GoAway()
+				conns = append(conns, call.c)
+			}
+		case <-ctx.Done():
+			for _, call := range calls[i:] {
+				go func(call *dialCall) {
+					<-call.done
+					if call.c != nil {
+						call.c.Close()
+					}
+				}(call)
+			}
+			for _, c := range conns {
+				c.Close()
+			}
+			return ctx.Err()
+		}
+	}
+
+	for i, c := range conns {
+		select {
+		case <-c.Closed():
+		case <-ctx.Done():
+			for _, c := range conns[i:] {
+				c.Close()
+			}
+			return ctx.Err()
+		}
+	}
+
+	return nil
 }
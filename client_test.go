@@ -0,0 +1,652 @@
+package spdy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestServer starts a TLS server that negotiates SPDY of the given version
+// and returns it along with a Transport that trusts it.
+func newTestServer(t *testing.T, version int, h http.Handler) (*httptest.Server, *Transport) {
+	proto := fmt.Sprintf("spdy/%d", version)
+	srv := httptest.NewUnstartedServer(h)
+	srv.TLS = &tls.Config{NextProtos: []string{proto}}
+	srv.Config.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){
+		proto: func(s *http.Server, sock *tls.Conn, h http.Handler) {
+			NewConnection(sock, h, version, true).Run()
+		},
+	}
+	srv.StartTLS()
+
+	tr := &Transport{
+		TLSClientConfig: srv.Client().Transport.(*http.Transport).TLSClientConfig,
+	}
+	return srv, tr
+}
+
+func testGet(t *testing.T, tr http.RoundTripper, url string) string {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+var helloHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "hello %s", r.URL.Path)
+})
+
+func TestCloseIdleConnections(t *testing.T) {
+	srv, tr := newTestServer(t, 3, helloHandler)
+	defer srv.Close()
+
+	if got := testGet(t, tr, srv.URL+"/foo"); got != "hello /foo" {
+		t.Fatalf("got %q", got)
+	}
+
+	conns := tr.Connections()
+	if len(conns) != 1 {
+		t.Fatalf("got %d connections", len(conns))
+	}
+	if conns[0].Origin != srv.URL || conns[0].Version != 3 || conns[0].NumStreams != 0 {
+		t.Fatalf("unexpected connection %+v", conns[0])
+	}
+
+	tr.lk.Lock()
+	c := tr.connections["|"+conns[0].Origin]
+	tr.lk.Unlock()
+
+	tr.CloseIdleConnections()
+
+	if conns := tr.Connections(); len(conns) != 0 {
+		t.Fatalf("connections not removed %+v", conns)
+	}
+
+	select {
+	case <-c.Closed():
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed")
+	}
+
+	// A new request should start a new connection.
+	if got := testGet(t, tr, srv.URL+"/bar"); got != "hello /bar" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestCloseAllConnections(t *testing.T) {
+	release := make(chan bool)
+	srv, tr := newTestServer(t, 3, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("done"))
+	}))
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL+"/", nil)
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if conns := tr.Connections(); len(conns) != 1 || conns[0].NumStreams != 1 {
+		t.Fatalf("unexpected connections %+v", conns)
+	}
+
+	// Idle closes should leave the busy connection alone.
+	tr.CloseIdleConnections()
+	if conns := tr.Connections(); len(conns) != 1 {
+		t.Fatalf("busy connection was closed")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := tr.CloseAllConnections(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline error, got %v", err)
+	}
+	close(release)
+
+	if _, err := ioutil.ReadAll(resp.Body); err == nil {
+		t.Fatal("expected the stream to be aborted")
+	}
+	resp.Body.Close()
+}
+
+// closeNotifyConn closes closed when the connection is closed.
+type closeNotifyConn struct {
+	net.Conn
+	once   sync.Once
+	closed chan bool
+}
+
+func (c *closeNotifyConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+func TestCloseAllConnectionsWhileDialing(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go Serve(l, helloHandler)
+
+	// Hold up the first dial until CloseAllConnections has been called
+	dialing := make(chan bool)
+	release := make(chan bool)
+	first := &closeNotifyConn{closed: make(chan bool)}
+	var dials int32
+
+	tr := &Transport{
+		CleartextVersion: 3,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			sock, err := net.Dial(network, addr)
+			if err != nil || atomic.AddInt32(&dials, 1) > 1 {
+				return sock, err
+			}
+
+			close(dialing)
+			<-release
+			first.Conn = sock
+			return first, nil
+		},
+	}
+
+	got := make(chan error)
+	go func() {
+		req, _ := http.NewRequest("GET", "http://"+l.Addr().String()+"/", nil)
+		resp, err := tr.RoundTrip(req)
+		if err == nil {
+			_, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		got <- err
+	}()
+
+	<-dialing
+	closed := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		closed <- tr.CloseAllConnections(ctx)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	if err := <-got; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+
+	// The connection that was being dialled has been shut down rather
+	// than cached.
+	select {
+	case <-first.closed:
+	case <-time.After(time.Second):
+		t.Fatal("the connection dialled during CloseAllConnections wasn't closed")
+	}
+}
+
+func TestCleartext(t *testing.T) {
+	for _, version := range []int{2, 3} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		go Serve(l, helloHandler)
+
+		tr := &Transport{CleartextVersion: version}
+		url := "http://" + l.Addr().String() + "/foo"
+		if got := testGet(t, tr, url); got != "hello /foo" {
+			t.Fatalf("got %q", got)
+		}
+
+		conns := tr.Connections()
+		if len(conns) != 1 || conns[0].Origin != "http://"+l.Addr().String() || conns[0].Version != version {
+			t.Fatalf("unexpected connections %+v", conns)
+		}
+
+		// Hosts not matching the patterns should go to the fallback
+		// client
+		tr = &Transport{CleartextVersion: version, CleartextHosts: []string{"*.internal"}}
+		req, _ := http.NewRequest("GET", url, nil)
+		if _, err := tr.RoundTrip(req); err == nil {
+			t.Fatal("expected an error without a fallback client")
+		}
+	}
+}
+
+func TestConcurrentDial(t *testing.T) {
+	srv, tr := newTestServer(t, 3, helloHandler)
+	defer srv.Close()
+
+	var lk sync.Mutex
+	dials := 0
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		lk.Lock()
+		dials++
+		lk.Unlock()
+		// Give the other requests time to queue up behind this dial
+		time.Sleep(50 * time.Millisecond)
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			path := fmt.Sprintf("/%d", i)
+			if got := testGet(t, tr, srv.URL+path); got != "hello "+path {
+				t.Errorf("got %q", got)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if dials != 1 {
+		t.Fatalf("got %d dials", dials)
+	}
+}
+
+func TestDialDoesNotBlockOtherHosts(t *testing.T) {
+	srv, tr := newTestServer(t, 3, helloHandler)
+	defer srv.Close()
+
+	blackhole := "blackhole.test:443"
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr == blackhole {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	errc := make(chan error)
+	go func() {
+		req, _ := http.NewRequestWithContext(ctx, "GET", "https://"+blackhole+"/", nil)
+		_, err := tr.RoundTrip(req)
+		errc <- err
+	}()
+
+	// Whilst the first dial hangs, other origins should still work
+	if got := testGet(t, tr, srv.URL+"/foo"); got != "hello /foo" {
+		t.Fatalf("got %q", got)
+	}
+
+	select {
+	case err := <-errc:
+		t.Fatalf("blackholed request finished early with %v", err)
+	default:
+	}
+
+	if err := <-errc; err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline error, got %v", err)
+	}
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Accept connections but never reply to the client hello
+	go func() {
+		for {
+			sock, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer sock.Close()
+		}
+	}()
+
+	tr := &Transport{TLSHandshakeTimeout: 50 * time.Millisecond}
+	req, _ := http.NewRequest("GET", "https://"+l.Addr().String()+"/", nil)
+
+	start := time.Now()
+	if _, err := tr.RoundTrip(req); err == nil {
+		t.Fatal("expected a handshake timeout")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("handshake took %v", d)
+	}
+}
+
+// newRefusingServer starts a cleartext SPDY/3 server where the first refused
+// connections answer every SYN_STREAM with the frame returned by refuse. Later
+// connections are served by echoHandler. It returns the server URL and a
+// count of accepted connections.
+func newRefusingServer(t *testing.T, refused int, refuse func(streamId int) frame) (string, *int32) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	conns := new(int32)
+	go func() {
+		for {
+			sock, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if int(atomic.AddInt32(conns, 1)) > refused {
+				go NewConnection(sock, echoHandler, 3, true).Run()
+			} else {
+				go refuseStreams(sock, refuse)
+			}
+		}
+	}()
+
+	return "http://" + l.Addr().String(), conns
+}
+
+func refuseStreams(sock net.Conn, refuse func(streamId int) frame) {
+	defer sock.Close()
+	h := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(sock, h); err != nil {
+			return
+		}
+		d := make([]byte, fromBig32(h[4:])&0xFFFFFF)
+		if _, err := io.ReadFull(sock, d); err != nil {
+			return
+		}
+		if fromBig32(h)&0x8000FFFF == synStreamCode {
+			refuse(int(fromBig32(d)&0x7FFFFFFF)).WriteFrame(sock, nil)
+		}
+	}
+}
+
+func refuseWithReset(streamId int) frame {
+	return &rstStreamFrame{Version: 3, StreamId: streamId, Reason: rstRefusedStream}
+}
+
+func refuseWithGoAway(streamId int) frame {
+	return &goAwayFrame{Version: 3, LastStreamId: streamId - 1}
+}
+
+func testPost(tr *Transport, url string, body io.Reader) (string, error) {
+	req, _ := http.NewRequest("POST", url, body)
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	return string(data), err
+}
+
+func TestRetryRefused(t *testing.T) {
+	for _, refuse := range []func(int) frame{refuseWithReset, refuseWithGoAway} {
+		url, conns := newRefusingServer(t, 2, refuse)
+		tr := &Transport{CleartextVersion: 3}
+
+		got, err := testPost(tr, url+"/foo", strings.NewReader("body"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != "POST /foo body" {
+			t.Fatalf("got %q", got)
+		}
+		if n := atomic.LoadInt32(conns); n != 3 {
+			t.Fatalf("got %d connections", n)
+		}
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	url, conns := newRefusingServer(t, 100, refuseWithReset)
+
+	tr := &Transport{CleartextVersion: 3, MaxRetries: 2}
+	if _, err := testPost(tr, url+"/", strings.NewReader("body")); err != ErrRefusedStream(1) {
+		t.Fatalf("expected a refused stream error, got %v", err)
+	}
+	if n := atomic.LoadInt32(conns); n != 3 {
+		t.Fatalf("got %d connections", n)
+	}
+
+	// Bodies that can't be rewound are not retried
+	atomic.StoreInt32(conns, 0)
+	body := ioutil.NopCloser(strings.NewReader("body"))
+	if _, err := testPost(tr, url+"/", body); err == nil {
+		t.Fatal("expected an error")
+	}
+	if n := atomic.LoadInt32(conns); n != 1 {
+		t.Fatalf("got %d connections", n)
+	}
+
+	// Nor are requests the policy rejects
+	atomic.StoreInt32(conns, 0)
+	var retryErr error
+	tr.RetryPolicy = func(req *http.Request, err error, retries int) bool {
+		retryErr = err
+		return false
+	}
+	if _, err := testPost(tr, url+"/", nil); err == nil {
+		t.Fatal("expected an error")
+	}
+	if n := atomic.LoadInt32(conns); n != 1 || retryErr != ErrRefusedStream(1) {
+		t.Fatalf("got %d connections, policy error %v", n, retryErr)
+	}
+}
+
+// readTracker records whether the body has been read.
+type readTracker struct {
+	io.Reader
+	read int32
+}
+
+func (r *readTracker) Read(p []byte) (int, error) {
+	atomic.StoreInt32(&r.read, 1)
+	return r.Reader.Read(p)
+}
+
+func TestExpectContinue(t *testing.T) {
+	for _, version := range []int{2, 3} {
+		srv, tr := newTestServer(t, version, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/reject" {
+				http.Error(w, "no", http.StatusUnauthorized)
+				return
+			}
+			io.Copy(w, r.Body)
+		}))
+		defer srv.Close()
+
+		tr.RequestExtra = &RequestExtra{ExpectContinueTimeout: time.Minute}
+
+		// Reading the body should ask the client to send it without
+		// waiting for the timeout.
+		body := &readTracker{Reader: strings.NewReader("body")}
+		req, _ := http.NewRequest("POST", srv.URL+"/echo", body)
+		req.Header.Set("Expect", "100-continue")
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(data) != "body" {
+			t.Fatalf("got %q", data)
+		}
+
+		// Answering without reading means the body is never sent
+		body = &readTracker{Reader: strings.NewReader("body")}
+		req, _ = http.NewRequest("POST", srv.URL+"/reject", body)
+		req.Header.Set("Expect", "100-continue")
+		resp, err = tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("got status %d", resp.StatusCode)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+		if atomic.LoadInt32(&body.read) != 0 {
+			t.Fatal("rejected body was sent")
+		}
+	}
+}
+
+func TestTransportDecompression(t *testing.T) {
+	srv, tr := newTestServer(t, 3, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Accept-Encoding", r.Header.Get("Accept-Encoding"))
+		if r.Header.Get("Accept-Encoding") == "" {
+			io.WriteString(w, "plain")
+			return
+		}
+
+		var buf bytes.Buffer
+		var zw io.WriteCloser
+		switch r.URL.Path {
+		case "/gzip":
+			zw = gzip.NewWriter(&buf)
+		case "/deflate":
+			zw = zlib.NewWriter(&buf)
+		}
+		io.WriteString(zw, "compressed")
+		zw.Close()
+
+		w.Header().Set("Content-Encoding", r.URL.Path[1:])
+		w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+		w.Write(buf.Bytes())
+	}))
+	defer srv.Close()
+
+	for _, path := range []string{"/gzip", "/deflate"} {
+		req, _ := http.NewRequest("GET", srv.URL+path, nil)
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(data) != "compressed" {
+			t.Fatalf("%s: got %q", path, data)
+		}
+		if resp.Header.Get("X-Accept-Encoding") != "gzip" {
+			t.Fatalf("%s: gzip not requested", path)
+		}
+		if !resp.Uncompressed || resp.ContentLength != -1 || resp.Header.Get("Content-Encoding") != "" || resp.Header.Get("Content-Length") != "" {
+			t.Fatalf("%s: unexpected response %+v", path, resp)
+		}
+		if req.Header.Get("Accept-Encoding") != "" {
+			t.Fatalf("%s: request was modified", path)
+		}
+	}
+
+	tr.DisableCompression = true
+	if got := testGet(t, tr, srv.URL+"/gzip"); got != "plain" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestServerRequestHandler(t *testing.T) {
+	srv, tr := newTestServer(t, 3, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := ConnectionFromRequest(r)
+		if c == nil {
+			http.Error(w, "no connection", http.StatusInternalServerError)
+			return
+		}
+
+		req, _ := http.NewRequest("GET", "https://client.test/callback", nil)
+		resp, err := c.RoundTrip(req)
+		if err != nil {
+			fmt.Fprintf(w, "callback failed: %v", err)
+			return
+		}
+		defer resp.Body.Close()
+		io.Copy(w, resp.Body)
+	}))
+	defer srv.Close()
+
+	if got := testGet(t, tr, srv.URL+"/"); !strings.HasPrefix(got, "callback failed") {
+		t.Fatalf("expected the callback to be refused, got %q", got)
+	}
+
+	srv2, tr2 := newTestServer(t, 3, srv.Config.Handler)
+	defer srv2.Close()
+	tr2.ServerRequestHandler = helloHandler
+
+	if got := testGet(t, tr2, srv2.URL+"/"); got != "hello /callback" {
+		t.Fatalf("got %q", got)
+	}
+
+	if ConnectionFromRequest(httptest.NewRequest("GET", "/", nil)) != nil {
+		t.Fatal("expected no connection for a HTTP request")
+	}
+}
+
+func TestExpectContinueInterop(t *testing.T) {
+	peer, sock := net.Pipe()
+	defer peer.Close()
+
+	c := NewConnection(sock, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}), 3, true)
+	go c.Run()
+
+	// Other clients don't send the continueHeader, so they don't get an
+	// interim HEADERS which SPDY doesn't allow.
+	syn := &synStreamFrame{
+		Version:    3,
+		StreamId:   1,
+		URL:        testurl,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Method:     "POST",
+		Header:     http.Header{"Expect": {"100-continue"}},
+	}
+	syn.WriteFrame(peer, new(compressor))
+	(&dataFrame{StreamId: 1, Data: []byte("body"), Finished: true}).WriteFrame(peer, nil)
+
+	if d := readFrame(t, peer); frameCode(d) != synReplyCode {
+		t.Fatalf("expected SYN_REPLY, got %X", d[:4])
+	}
+}
@@ -0,0 +1,125 @@
+// Command spdyproxy runs a forward proxy that SPDY clients can use to
+// multiplex requests for many origins over a single session.
+//
+// Usage:
+//
+//	spdyproxy -addr :8443 -cert cert.pem -key key.pem [-users users.txt] [-client-ca ca.pem] [-open]
+//
+// The users file has one user:password per line. If -client-ca is given
+// then clients presenting a certificate signed by that CA are allowed in
+// without a password. One of -users or -client-ca is required, unless -open
+// is given to let anyone use the proxy.
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	spdy "github.com/markchadwick/gospdy"
+)
+
+var (
+	addr     = flag.String("addr", ":8443", "address to listen on")
+	certFile = flag.String("cert", "", "TLS certificate file")
+	keyFile  = flag.String("key", "", "TLS key file")
+	users    = flag.String("users", "", "file of user:password lines allowed to use the proxy")
+	clientCA = flag.String("client-ca", "", "CA certificates that client certificates are verified against")
+	open     = flag.Bool("open", false, "allow anyone to use the proxy without -users or -client-ca")
+)
+
+func loadUsers(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ret := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		split := strings.SplitN(line, ":", 2)
+		if len(split) != 2 {
+			return nil, errors.New("invalid users line: " + line)
+		}
+		ret[split[0]] = split[1]
+	}
+
+	return ret, scanner.Err()
+}
+
+func main() {
+	flag.Parse()
+
+	if *certFile == "" || *keyFile == "" {
+		log.Fatal("spdyproxy: -cert and -key are required")
+	}
+
+	if *users == "" && *clientCA == "" {
+		if !*open {
+			log.Fatal("spdyproxy: -users or -client-ca is required, or -open to allow anyone")
+		}
+		log.Print("spdyproxy: warning: the proxy is open to anyone")
+	}
+
+	cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+	proxy := &spdy.ForwardProxy{Realm: "spdyproxy"}
+
+	if *clientCA != "" {
+		pem, err := ioutil.ReadFile(*clientCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Fatalf("spdyproxy: no certificates in %s", *clientCA)
+		}
+
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		proxy.AllowClientCert = func(*x509.Certificate) bool {
+			// Any certificate that verified against the CA
+			return true
+		}
+	}
+
+	if *users != "" {
+		passwords, err := loadUsers(*users)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		proxy.AllowUser = func(user, password string) bool {
+			// Compare even for unknown users so that the timing
+			// doesn't give away which users exist
+			want, ok := passwords[user]
+			match := subtle.ConstantTimeCompare([]byte(want), []byte(password)) == 1
+			return ok && match
+		}
+	}
+
+	l, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Fatal(spdy.ServeTLS(l, cfg, proxy))
+}
@@ -0,0 +1,358 @@
+package spdy
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// DefaultCompressTypes are the content types compressed by CompressHandler
+// when ContentTypes is nil. Entries ending with a slash match any subtype.
+var DefaultCompressTypes = []string{
+	"text/",
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"application/xhtml+xml",
+	"image/svg+xml",
+}
+
+// DefaultCompressMinLength is the smallest response compressed by
+// CompressHandler when MinLength is zero.
+const DefaultCompressMinLength = 1024
+
+// CompressHandler is a http.Handler that gzip or deflate encodes responses
+// from Handler for clients that accept it. Unlike
+// Stream.EnableOutputCompression this uses the standard Content-Encoding and
+// so works with any client.
+//
+// Responses that already have a Content-Encoding, partial responses, small
+// responses and those with content types not listed in ContentTypes are left
+// alone. Enough of the response is held back to decide whether to compress,
+// until the handler calls Flush. A Flush before any data without a
+// Content-Type doesn't send the header, as there's nothing to sniff.
+//
+// The ResponseWriter given to Handler is still a Stream for SPDY requests
+// and can be hijacked as long as the response isn't being compressed.
+type CompressHandler struct {
+	Handler http.Handler
+
+	// ContentTypes lists the content types to compress. If nil
+	// DefaultCompressTypes is used.
+	ContentTypes []string
+
+	// MinLength is the smallest response that is compressed. If zero
+	// DefaultCompressMinLength is used.
+	MinLength int
+
+	// Level is the gzip/zlib compression level. If zero the default
+	// level is used.
+	Level int
+}
+
+func (h *CompressHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cw := &compressWriter{
+		ResponseWriter: w,
+		handler:        h,
+		encoding:       negotiateEncoding(r.Header.Get("Accept-Encoding")),
+		status:         http.StatusOK,
+	}
+
+	if r.Method == "HEAD" {
+		cw.encoding = ""
+	}
+
+	defer cw.close()
+
+	if _, ok := w.(Stream); ok {
+		h.Handler.ServeHTTP(compressStream{cw}, r)
+	} else {
+		h.Handler.ServeHTTP(cw, r)
+	}
+}
+
+// negotiateEncoding picks gzip or deflate from an Accept-Encoding header,
+// preferring gzip. It returns an empty string if neither is acceptable.
+func negotiateEncoding(accept string) string {
+	q := make(map[string]float64)
+
+	for _, part := range strings.Split(accept, ",") {
+		split := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(split[0]))
+		if coding == "" {
+			continue
+		}
+
+		val := 1.0
+		for _, param := range split[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if f, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					val = f
+				}
+			}
+		}
+
+		q[coding] = val
+	}
+
+	for _, coding := range []string{"gzip", "deflate"} {
+		val, ok := q[coding]
+		if !ok {
+			val, ok = q["*"]
+		}
+		if ok && val > 0 {
+			return coding
+		}
+	}
+
+	return ""
+}
+
+// compressWriter buffers the start of the response until it knows whether to
+// compress it and then writes through to the underlying ResponseWriter,
+// optionally via a compressor.
+type compressWriter struct {
+	http.ResponseWriter
+	handler  *CompressHandler
+	encoding string
+
+	status   int
+	buf      []byte
+	decided  bool
+	flushing bool // Flush was called before there was anything to go on
+	zw       interface {
+		io.WriteCloser
+		Flush() error
+	}
+}
+
+func (s *compressWriter) minLength() int {
+	if s.handler.MinLength > 0 {
+		return s.handler.MinLength
+	}
+	return DefaultCompressMinLength
+}
+
+// eligible returns whether the response can be compressed, ignoring its
+// length.
+func (s *compressWriter) eligible() bool {
+	h := s.Header()
+
+	if h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" {
+		return false
+	}
+
+	switch {
+	case s.status < 200,
+		s.status == http.StatusNoContent,
+		s.status == http.StatusPartialContent,
+		s.status == http.StatusNotModified:
+		return false
+	}
+
+	// Sniff the type as it would be without compression, as neither SPDY
+	// streams nor net/http can once the body is compressed.
+	ctype := h.Get("Content-Type")
+	if ctype == "" && len(s.buf) > 0 {
+		ctype = http.DetectContentType(s.buf)
+		h.Set("Content-Type", ctype)
+	}
+
+	media, _, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		return false
+	}
+
+	types := s.handler.ContentTypes
+	if types == nil {
+		types = DefaultCompressTypes
+	}
+
+	for _, t := range types {
+		if media == t || (strings.HasSuffix(t, "/") && strings.HasPrefix(media, t)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// decide writes the header, compressing if the response is eligible and
+// either long enough or is being flushed.
+func (s *compressWriter) decide(flushing bool) {
+	s.decided = true
+	h := s.Header()
+
+	if s.eligible() {
+		// The response would be compressed for a different
+		// Accept-Encoding
+		h.Add("Vary", "Accept-Encoding")
+
+		length := len(s.buf)
+		if cl, err := strconv.Atoi(h.Get("Content-Length")); err == nil {
+			length = cl
+		}
+
+		if s.encoding != "" && (flushing || length >= s.minLength()) {
+			s.startCompressor()
+		}
+	}
+
+	s.ResponseWriter.WriteHeader(s.status)
+
+	if len(s.buf) > 0 {
+		if s.zw != nil {
+			s.zw.Write(s.buf)
+		} else {
+			s.ResponseWriter.Write(s.buf)
+		}
+	}
+	s.buf = nil
+}
+
+func (s *compressWriter) startCompressor() {
+	level := s.handler.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+
+	// An invalid level leaves the response uncompressed
+	if s.encoding == "gzip" {
+		if zw, err := gzip.NewWriterLevel(s.ResponseWriter, level); err == nil {
+			s.zw = zw
+		}
+	} else {
+		if zw, err := zlib.NewWriterLevel(s.ResponseWriter, level); err == nil {
+			s.zw = zw
+		}
+	}
+
+	if s.zw != nil {
+		h := s.Header()
+		h.Set("Content-Encoding", s.encoding)
+		h.Del("Content-Length")
+	}
+}
+
+func (s *compressWriter) WriteHeader(status int) {
+	s.status = status
+}
+
+func (s *compressWriter) Write(data []byte) (int, error) {
+	if !s.decided {
+		s.buf = append(s.buf, data...)
+		if len(s.buf) < s.minLength() && !s.flushing {
+			return len(data), nil
+		}
+		s.decide(s.flushing)
+		return len(data), nil
+	}
+
+	if s.zw != nil {
+		return s.zw.Write(data)
+	}
+
+	return s.ResponseWriter.Write(data)
+}
+
+// Flush sends what has been written so far, compressing it if the response is
+// eligible regardless of its length. Until there is either some data or a
+// Content-Type to decide on, nothing is sent and the next write is treated as
+// flushed.
+func (s *compressWriter) Flush() {
+	if !s.decided {
+		if len(s.buf) == 0 && s.Header().Get("Content-Type") == "" {
+			s.flushing = true
+			return
+		}
+		s.decide(true)
+	}
+
+	if s.zw != nil {
+		s.zw.Flush()
+	}
+
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack hijacks the underlying connection, passing on anything written so
+// far uncompressed. It returns http.ErrNotSupported if the underlying
+// ResponseWriter can't be hijacked or the response is already being
+// compressed.
+func (s *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok || s.zw != nil {
+		return nil, nil, http.ErrNotSupported
+	}
+
+	if !s.decided {
+		s.decided = true
+
+		// Streams reply with the status when hijacked
+		if s.status != http.StatusOK {
+			s.ResponseWriter.WriteHeader(s.status)
+		}
+		if len(s.buf) > 0 {
+			s.ResponseWriter.Write(s.buf)
+			s.buf = nil
+		}
+	}
+
+	return h.Hijack()
+}
+
+func (s *compressWriter) close() {
+	if !s.decided {
+		s.decide(false)
+	}
+
+	if s.zw != nil {
+		s.zw.Close()
+	}
+}
+
+// compressStream is the compressWriter for SPDY streams, passing on the rest
+// of the Stream methods.
+type compressStream struct {
+	*compressWriter
+}
+
+var _ Stream = compressStream{}
+var _ http.Hijacker = compressStream{}
+
+func (s compressStream) stream() Stream {
+	return s.ResponseWriter.(Stream)
+}
+
+func (s compressStream) SetPriority(priority int) {
+	s.stream().SetPriority(priority)
+}
+
+func (s compressStream) Priority() int {
+	return s.stream().Priority()
+}
+
+func (s compressStream) EnableOutputCompression(compressed bool) {
+	s.stream().EnableOutputCompression(compressed)
+}
+
+func (s compressStream) EnableOutputBuffering(buffering bool) {
+	s.stream().EnableOutputBuffering(buffering)
+}
+
+func (s compressStream) PushRequest(req *http.Request, extra *RequestExtra) (*http.Response, error) {
+	return s.stream().PushRequest(req, extra)
+}
+
+func (s compressStream) RoundTrip(r *http.Request) (*http.Response, error) {
+	return s.stream().RoundTrip(r)
+}
@@ -0,0 +1,202 @@
+package spdy
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := map[string]string{
+		"":                       "",
+		"gzip":                   "gzip",
+		"deflate, gzip":          "gzip",
+		"gzip;q=0, deflate":      "deflate",
+		"identity":               "",
+		"*":                      "gzip",
+		"*;q=0.5, gzip;q=0":      "deflate",
+		"GZIP;q=0.1, br":         "gzip",
+		"deflate;q=0, gzip; q=0": "",
+	}
+
+	for accept, want := range tests {
+		if got := negotiateEncoding(accept); got != want {
+			t.Errorf("%q: got %q want %q", accept, got, want)
+		}
+	}
+}
+
+func TestCompressHandler(t *testing.T) {
+	long := strings.Repeat("hello world ", 200)
+	flushed := make(chan bool)
+
+	srv, tr := newTestServer(t, 3, &CompressHandler{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/long":
+			io.WriteString(w, long)
+		case "/short":
+			io.WriteString(w, "hello")
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			io.WriteString(w, long)
+		case "/encoded":
+			w.Header().Set("Content-Encoding", "br")
+			io.WriteString(w, long)
+		case "/early":
+			// Flushed before there's anything to sniff
+			w.(http.Flusher).Flush()
+			io.WriteString(w, "\x89PNG\r\n\x1a\n")
+			io.WriteString(w, long)
+		case "/flush":
+			io.WriteString(w, "first")
+			w.(http.Flusher).Flush()
+			<-flushed
+			io.WriteString(w, "second")
+		}
+	})})
+	defer srv.Close()
+
+	// Do the decoding ourselves so we can see the raw response
+	tr.DisableCompression = true
+
+	get := func(path string) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", srv.URL+path, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, string(data)
+	}
+
+	resp, data := get("/long")
+	if resp.Header.Get("Content-Encoding") != "gzip" || resp.Header.Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("long response not compressed %+v", resp.Header)
+	}
+	if ctype := resp.Header.Get("Content-Type"); ctype != "text/plain; charset=utf-8" {
+		t.Fatalf("expected the sniffed content type, got %q", ctype)
+	}
+	zr, err := gzip.NewReader(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadAll(zr); string(got) != long {
+		t.Fatalf("got %q", got)
+	}
+
+	if resp, _ := get("/early"); resp.Header.Get("Content-Encoding") != "" || resp.Header.Get("Content-Type") != "image/png" {
+		t.Fatalf("early flushed image was compressed %+v", resp.Header)
+	}
+
+	for _, path := range []string{"/short", "/image", "/encoded"} {
+		resp, data := get(path)
+		if path != "/encoded" && resp.Header.Get("Content-Encoding") != "" {
+			t.Fatalf("%s: unexpected encoding %q", path, resp.Header.Get("Content-Encoding"))
+		}
+		if path == "/short" && (data != "hello" || resp.Header.Get("Vary") != "Accept-Encoding") {
+			t.Fatalf("%s: unexpected response %q %+v", path, data, resp.Header)
+		}
+		if path != "/short" && data != long {
+			t.Fatalf("%s: response was altered", path)
+		}
+	}
+
+	// Flushed data should arrive compressed before the handler finishes
+	req, _ := http.NewRequest("GET", srv.URL+"/flush", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err = tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	zr, err = gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(zr, buf); err != nil || string(buf) != "first" {
+		t.Fatalf("got %q %v", buf, err)
+	}
+	close(flushed)
+	if rest, _ := ioutil.ReadAll(zr); string(rest) != "second" {
+		t.Fatalf("got %q", rest)
+	}
+}
+
+func TestCompressHandlerHTTP(t *testing.T) {
+	long := strings.Repeat("<p>hello world</p>", 100)
+	srv := httptest.NewServer(&CompressHandler{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, long)
+	})})
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := (&http.Transport{DisableCompression: true}).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// net/http would otherwise sniff the gzipped body
+	if resp.Header.Get("Content-Encoding") != "gzip" || resp.Header.Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Fatalf("unexpected headers %+v", resp.Header)
+	}
+}
+
+func TestCompressHandlerInterfaces(t *testing.T) {
+	h := &CompressHandler{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stream" {
+			_, ok := w.(Stream)
+			fmt.Fprint(w, ok)
+			return
+		}
+
+		// Hijacking works as long as nothing has been compressed
+		sock, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer sock.Close()
+
+		if _, ok := w.(Stream); !ok {
+			io.WriteString(sock, "HTTP/1.1 200 OK\r\nContent-Length: 8\r\n\r\n")
+		}
+		io.WriteString(sock, "hijacked")
+	})}
+
+	spdy, tr := newTestServer(t, 3, h)
+	defer spdy.Close()
+	plain := httptest.NewServer(h)
+	defer plain.Close()
+
+	tests := []struct {
+		tr   http.RoundTripper
+		url  string
+		want string
+	}{
+		{tr, spdy.URL + "/stream", "true"},
+		{tr, spdy.URL + "/hijack", "hijacked"},
+		{http.DefaultTransport, plain.URL + "/stream", "false"},
+		{http.DefaultTransport, plain.URL + "/hijack", "hijacked"},
+	}
+
+	for _, test := range tests {
+		if got := testGet(t, test.tr, test.url); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.url, got, test.want)
+		}
+	}
+}
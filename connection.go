@@ -3,14 +3,19 @@ package spdy
 import (
 	"bufio"
 	"bytes"
+	"compress/zlib"
+	"context"
 	"crypto/tls"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 // data in connections are only accessible on the connection dispatch thread
@@ -21,13 +26,53 @@ type Connection struct {
 	handler    http.Handler
 	remoteAddr net.Addr
 	tls        *tls.ConnectionState
-	rxWindow   int
+
+	// initial per stream flow control windows, rxWindow is ours and
+	// txWindow the remote's
+	rxWindow int
+	txWindow int
+
+	// when to send WINDOW_UPDATEs, see SetWindowUpdate
+	rxUpdateFraction float64
+	rxUpdateDelay    time.Duration
+
+	// largest control frame we accept, see SetMaxControlFrameSize
+	rxMaxControlFrame int
+
+	// header compression, see SetHeaderCompression and
+	// SetSensitiveHeaders
+	txHeaderLevel int
+	txSensitive   map[string]bool
+
+	// reused for each DATA frame received
+	rxFrame dataFrame
+
+	// limits on frames from the remote that cost us work, see
+	// SetRateLimits
+	rxLimits       RateLimits
+	rxPings        rateCounter
+	rxSettings     rateCounter
+	rxResets       rateCounter
+	rxResetStreams rateCounter
+
+	// see SetTimeouts
+	timeouts Timeouts
+
+	// stream window auto-tuning, see SetAutoTuneBudget
+	rxBudget     int
+	rxBudgetUsed int64 // atomic
+	rtt          int64 // atomic, in nanoseconds and zero until measured
+	rttPingId    uint32
+	rttPingSent  time.Time
+
+	// whether the remote has seen our window, until then it uses the
+	// default for streams that it opens
+	rxWindowAcked bool
 
 	// tx thread channels
 	sendControl      chan frame
 	sendWindowUpdate chan frame
 	sendData         [maxPriorities]chan frame
-	dataSent         chan error
 
 	// dispatch thread channels
 	onStartRequest   chan *stream // do not use directly, use startRequest instead
@@ -37,6 +82,17 @@ type Connection struct {
 	// replies this happens when the handler function returns.
 	onStreamFinished chan *stream
 
+	// RawStream.Reset
+	onStreamReset chan *stream
+
+	// a stream's timeout timer has fired, see checkTimeouts
+	onStreamTimeout chan *stream
+
+	// raw streams opened by the remote waiting for AcceptStream, see
+	// SetAcceptStreams
+	acceptStreams bool
+	accepted      chan *stream
+
 	// stream info
 	streams          map[int]*stream
 	lastStreamOpened int
@@ -45,32 +101,66 @@ type Connection struct {
 	goAway   bool
 	onGoAway chan bool
 
+	// user requests to shut down the connection or query its state
+	onShutdown     chan bool // value is true to only shut down when idle
+	onShutdownDone chan bool // whether the connection is shutting down
+	onNumStreams   chan bool
+	numStreams     chan int
+
+	// closed once Run has returned
+	closed chan bool
+
+	// socket error set by the rx thread before it closes the dispatch
+	// channel
+	rxErr error
+
 	nextPingId uint32
 }
 
+// closeFrame is queued on the control channel to close the socket once all
+// of the frames queued before it have been written out.
+type closeFrame struct{}
+
+func (s closeFrame) WriteFrame(w io.Writer, c *compressor) error {
+	return nil
+}
+
+// queueClose closes the socket once the frames already queued have been
+// written out. If the remote has stopped reading and the control queue is
+// full then the socket is closed straight away rather than blocking the
+// connection thread.
+func (c *Connection) queueClose() {
+	select {
+	case c.sendControl <- closeFrame{}:
+	default:
+		c.socket.Close()
+	}
+}
+
 // nextTxFrame gets the next frame to be written to the socket in prioritized
-// order. If it has to block it will flush the output buffer first.
-func (c *Connection) nextTxFrame(buf *bufio.Writer) (frame, chan error) {
+// order. If it has to block it will flush the output buffer first, so that
+// frames queued together go out in a single write.
+func (c *Connection) nextTxFrame(buf *bufio.Writer) frame {
 	// try a non-blocking receive in priority order
 
 	// TODO(james): change back to a single select once go issue 2401 is
 	// resolved (this segfaults on arm)
 	select {
 	case f := <-c.sendControl:
-		return f, nil
+		return f
 	default:
 	}
 
 	select {
 	case f := <-c.sendWindowUpdate:
-		return f, nil
+		return f
 	default:
 	}
 
 	for _, ch := range c.sendData {
 		select {
 		case f := <-ch:
-			return f, c.dataSent
+			return f
 		default:
 		}
 	}
@@ -80,25 +170,25 @@ func (c *Connection) nextTxFrame(buf *bufio.Writer) (frame, chan error) {
 	// do a blocking receive on all the send channels
 	select {
 	case f := <-c.sendControl:
-		return f, nil
+		return f
 	case f := <-c.sendWindowUpdate:
-		return f, nil
+		return f
 	case f := <-c.sendData[0]:
-		return f, c.dataSent
+		return f
 	case f := <-c.sendData[1]:
-		return f, c.dataSent
+		return f
 	case f := <-c.sendData[2]:
-		return f, c.dataSent
+		return f
 	case f := <-c.sendData[3]:
-		return f, c.dataSent
+		return f
 	case f := <-c.sendData[4]:
-		return f, c.dataSent
+		return f
 	case f := <-c.sendData[5]:
-		return f, c.dataSent
+		return f
 	case f := <-c.sendData[6]:
-		return f, c.dataSent
+		return f
 	case f := <-c.sendData[7]:
-		return f, c.dataSent
+		return f
 	}
 
 	panic("unreachable")
@@ -108,79 +198,208 @@ func (c *Connection) nextTxFrame(buf *bufio.Writer) (frame, chan error) {
 // session tx threads and writes them out to the underlying socket. The frames
 // are prioritized by receiving from a number of send channels which are
 // polled from highest priority to lowest before blocking on them all.
+//
+// Frames are encoded into a shared buffer which is only written out once
+// there is nothing more to send, so that frames from many streams are
+// coalesced into one write. Senders don't wait for their frames to be
+// written, see stream.sendFrame.
 func (c *Connection) txPump() {
-	buf := bufio.NewWriter(c.socket)
-	zip := compressor{}
+	buf := bufio.NewWriterSize(c.socket, txBufferSize)
+	zip := compressor{level: c.txHeaderLevel, sensitive: c.txSensitive}
 
 	for {
-		f, finish := c.nextTxFrame(buf)
+		f := c.nextTxFrame(buf)
 		if f == nil {
 			break
 		}
 
-		err := f.WriteFrame(c.socket, &zip)
-		if finish != nil {
-			finish <- err
+		if _, ok := f.(closeFrame); ok {
+			buf.Flush()
+			c.socket.Close()
+			continue
+		}
+
+		err := f.WriteFrame(buf, &zip)
+
+		if d, ok := f.(*dataFrame); ok {
+			releaseTxData(d)
+		}
+
+		// Either the socket has failed, in which case closing it
+		// gets the rx thread to tear down the connection, or the
+		// compressor has and the session is unusable.
+		if err != nil {
+			log.Printf("spdy: tx error: %v", err)
+			c.socket.Close()
 		}
 	}
 }
 
 // rxPump runs the connection receive loop for both client and server
-// connections. It then finds the message boundaries and sends each one over
-// to the connection thread.
-func (c *Connection) rxPump(dispatch chan []byte, dispatched chan error, rxError chan error) {
-
-	buf := new(buffer)
+// connections. It finds the message boundaries and sends each frame over to
+// the connection thread in its own pooled buffer. Frames are queued up on
+// the dispatch channel rather than waiting for each one to be handled, so
+// that a burst of frames costs no more than one handoff.
+func (c *Connection) rxPump(dispatch chan []byte) {
+	r := bufio.NewReaderSize(c.socket, defaultBufferSize)
+	t := frameTimer{conn: c.socket, timeout: c.timeouts.Header}
+	var hdr [8]byte
 
 	for {
-		d, err := buf.Get(c.socket, 8)
-		if err != nil {
-			rxError <- err
+		if err := t.start(r); err != nil {
+			c.rxFailed(dispatch, err)
 			return
 		}
 
-		length := int(fromBig32(d[4:])&0xFFFFFF) + 8
-
-		d, err = buf.Get(c.socket, length)
-		// If the buffer overflows we will not get an error instead
-		// len(d) < 8 + length. We try and continue anyways, and the
-		// disptach thread can decide whether we need to throw a
-		// session error and disconnect or just send a stream error.
-		if err != nil {
-			rxError <- err
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			c.rxFailed(dispatch, err)
 			return
 		}
 
-		dispatch <- d
-		err = <-dispatched
+		var err error
+		if fromBig32(hdr[0:])&0x80000000 == 0 {
+			t.stop()
+			err = c.rxData(r, hdr, dispatch)
+		} else {
+			t.wait(r, int(fromBig32(hdr[4:])&0xFFFFFF))
+			err = c.rxControl(r, hdr, dispatch)
+			t.stop()
+		}
 
-		if err != nil {
-			rxError <- err
+		if err == errConnectionDone {
+			return
+		} else if err != nil {
+			c.rxFailed(dispatch, err)
 			return
 		}
+	}
+}
 
-		buf.Flush(len(d))
-		length -= len(d)
+// frameTimer sets a read deadline on the socket for Timeouts.Header, so
+// that a frame can't be trickled in once it has started. The deadline is
+// only set when we have to wait for more of the frame.
+type frameTimer struct {
+	conn     net.Conn
+	timeout  time.Duration
+	deadline time.Time
+}
 
-		// If we couldn't buffer all of the message above, consume the
-		// rest of the data in the message and dump the data on the
-		// floor.
-		for length > 0 {
-			d, err := buf.Get(c.socket, length)
-			if err != nil {
-				rxError <- err
-				return
-			}
+// start waits for the next frame to start arriving, with no deadline.
+func (t *frameTimer) start(r *bufio.Reader) error {
+	if t.timeout <= 0 || r.Buffered() >= 8 {
+		return nil
+	}
+
+	if _, err := r.Peek(1); err != nil {
+		return err
+	}
+
+	t.wait(r, 8)
+	return nil
+}
+
+// wait sets the deadline if fewer than n bytes are buffered.
+func (t *frameTimer) wait(r *bufio.Reader, n int) {
+	if t.timeout > 0 && t.deadline.IsZero() && r.Buffered() < n {
+		t.deadline = time.Now().Add(t.timeout)
+		t.conn.SetReadDeadline(t.deadline)
+	}
+}
+
+// stop clears the deadline once the frame has arrived.
+func (t *frameTimer) stop() {
+	if !t.deadline.IsZero() {
+		t.deadline = time.Time{}
+		t.conn.SetReadDeadline(time.Time{})
+	}
+}
 
-			buf.Flush(len(d))
-			length -= len(d)
+// rxData passes on a DATA frame in pieces that fit in our rx buffers, so
+// that frames of any size reach the stream as they arrive. Only the last
+// piece carries the FIN flag.
+func (c *Connection) rxData(r io.Reader, hdr [8]byte, dispatch chan []byte) error {
+	length := int(fromBig32(hdr[4:]) & 0xFFFFFF)
+	flags := hdr[4]
+
+	for first := true; first || length > 0; first = false {
+		n := length
+		if n > defaultBufferSize-8 {
+			n = defaultBufferSize - 8
+		}
+		length -= n
+
+		d := getRxBuffer(8 + n)
+		copy(d, hdr[:4])
+		toBig32(d[4:], uint32(n))
+		d[4] = flags
+		if length > 0 {
+			d[4] &^= finishedFlag
+		}
+
+		if _, err := io.ReadFull(r, d[8:]); err != nil {
+			releaseRxBuffer(d)
+			return err
+		}
+
+		if err := c.rxDispatch(dispatch, d); err != nil {
+			return err
 		}
 	}
+
+	return nil
+}
+
+// rxControl passes on a control frame. If the frame is over the size limit
+// then we only pass on the start of it, up to the stream id, and len(d) <
+// 8 + length. The dispatch thread then decides how to reject it.
+func (c *Connection) rxControl(r *bufio.Reader, hdr [8]byte, dispatch chan []byte) error {
+	length := int(fromBig32(hdr[4:]) & 0xFFFFFF)
+
+	n := length
+	if n > c.rxMaxControlFrame && n > 4 {
+		n = 4
+	}
+
+	d := getRxBuffer(8 + n)
+	copy(d, hdr[:])
+
+	if _, err := io.ReadFull(r, d[8:]); err != nil {
+		releaseRxBuffer(d)
+		return err
+	}
+
+	if _, err := r.Discard(length - n); err != nil {
+		releaseRxBuffer(d)
+		return err
+	}
+
+	return c.rxDispatch(dispatch, d)
+}
+
+// rxDispatch queues a frame for the connection thread.
+func (c *Connection) rxDispatch(dispatch chan []byte, d []byte) error {
+	select {
+	case dispatch <- d:
+		return nil
+	case <-c.closed:
+		releaseRxBuffer(d)
+		return errConnectionDone
+	}
+}
+
+// rxFailed passes a socket error to the connection thread by closing the
+// dispatch channel, so that the frames queued before the error are handled
+// first.
+func (c *Connection) rxFailed(dispatch chan []byte, err error) {
+	c.rxErr = err
+	close(dispatch)
 }
 
 // run runs the main connection thread which is responsible for dispatching
 // messages to the streams and managing the list of streams.
 func (c *Connection) Run() {
+	defer close(c.closed)
+
 	unzip := decompressor{}
 
 	if t, ok := c.socket.(*tls.Conn); ok {
@@ -192,12 +411,32 @@ func (c *Connection) Run() {
 		*c.tls = t.ConnectionState()
 	}
 
-	dispatch := make(chan []byte)
-	dispatched := make(chan error)
-	rxError := make(chan error)
+	announce := c.version >= 3 && c.rxWindow != defaultWindow
+	if announce {
+		c.rxWindowAcked = false
+		c.sendControl <- &settingsFrame{
+			Version:    c.version,
+			HaveWindow: true,
+			Window:     c.rxWindow,
+		}
+	}
+
+	// The PING reply tells us when the remote has seen our window and
+	// gives auto-tuning the round trip time.
+	if announce || (c.version >= 3 && c.rxBudget > 0) {
+		c.rttPingId = c.nextPingId
+		c.nextPingId += 2
+		c.rttPingSent = time.Now()
+		c.sendControl <- &pingFrame{
+			Version: c.version,
+			Id:      c.rttPingId,
+		}
+	}
+
+	dispatch := make(chan []byte, maxDispatchQueue)
 
 	go c.txPump()
-	go c.rxPump(dispatch, dispatched, rxError)
+	go c.rxPump(dispatch)
 
 	for {
 		select {
@@ -205,6 +444,12 @@ func (c *Connection) Run() {
 			err := c.handleStartRequest(s)
 			c.onRequestStarted <- err
 
+		case idleOnly := <-c.onShutdown:
+			c.onShutdownDone <- c.shutdown(idleOnly)
+
+		case <-c.onNumStreams:
+			c.numStreams <- len(c.streams)
+
 		case s := <-c.onStreamFinished:
 			// Handle the race where we sent/received a reset
 			// before we handled this message.
@@ -218,22 +463,36 @@ func (c *Connection) Run() {
 
 			c.finishStream(s, ErrCancel(s.streamId))
 
-		case d := <-dispatch:
+		case s := <-c.onStreamReset:
+			if c.streams[s.streamId] != s {
+				break
+			}
+
+			c.sendReset(s.streamId, rstCancel)
+			c.finishStream(s, ErrCancel(s.streamId))
+
+		case s := <-c.onStreamTimeout:
+			c.checkTimeouts(s)
+
+		case d, ok := <-dispatch:
+			if !ok {
+				c.abort(c.rxErr)
+				return
+			}
+
 			err := c.handleFrame(d, &unzip)
 
 			if err == nil {
-				dispatched <- nil
 				break
 			}
 
 			serr, ok := err.(streamError)
 
 			// Session error, we are going to abort the
-			// connection. Send the error to the rx thread, it
-			// will then send it back in rxError.
+			// connection.
 			if !ok {
-				dispatched <- err
-				break
+				c.abort(err)
+				return
 			}
 
 			// Stream error, abort the stream
@@ -243,27 +502,83 @@ func (c *Connection) Run() {
 			if s := c.streams[sid]; s != nil {
 				c.finishStream(s, err)
 			}
+		}
+	}
+}
 
-			dispatched <- nil
+// abort tears down the connection after a session error. The rx thread
+// exits once the socket is closed and the connection thread has returned.
+func (c *Connection) abort(err error) {
+	c.setGoAway()
+	for _, s := range c.streams {
+		c.finishStream(s, err)
+	}
 
-		case err := <-rxError:
-			// Session error, have to abort the whole connection
-			c.goAway = true
-			close(c.onGoAway)
-			for _, s := range c.streams {
-				c.finishStream(s, err)
-			}
+	// close the control channel to ensure that the tx
+	// thread shuts down
+	close(c.sendControl)
+	c.socket.Close()
+}
 
-			// close the control channel to ensure that the tx
-			// thread shuts down
-			close(c.sendControl)
-			c.socket.Close()
-			return
-		}
+// closeSession aborts all of the streams with err and sends a GO_AWAY with
+// the given reason before closing the socket. The connection thread carries
+// on until the rx thread sees the socket close.
+func (c *Connection) closeSession(err error, reason int) {
+	c.sendGoAway(reason)
+	c.queueClose()
+
+	for _, s := range c.streams {
+		c.finishStream(s, err)
+	}
+}
+
+// sendGoAway stops any further streams from being started and sends a
+// GO_AWAY with the given reason, unless one has already been sent. If the
+// remote has stopped reading and filled the control queue then the socket is
+// closed instead, as there's no point waiting to flush it and blocking the
+// connection thread.
+func (c *Connection) sendGoAway(reason int) {
+	if c.goAway {
+		return
+	}
+
+	c.setGoAway()
+	select {
+	case c.sendControl <- &goAwayFrame{
+		Version:      c.version,
+		LastStreamId: c.lastStreamOpened,
+		Reason:       reason,
+	}:
+	default:
+		c.socket.Close()
 	}
 }
 
-func (c *Connection) shutdown() {
+// setGoAway stops any further streams from being started on the
+// connection.
+func (c *Connection) setGoAway() {
+	if !c.goAway {
+		c.goAway = true
+		close(c.onGoAway)
+	}
+}
+
+// shutdown sends a GO_AWAY to the remote so that no more streams are started
+// on the connection. The socket is closed once all of the active streams have
+// finished. If idleOnly is set then this only happens if there are currently
+// no active streams.
+func (c *Connection) shutdown(idleOnly bool) bool {
+	if idleOnly && len(c.streams) > 0 {
+		return false
+	}
+
+	c.sendGoAway(rstSuccess)
+
+	if len(c.streams) == 0 {
+		c.queueClose()
+	}
+
+	return true
 }
 
 /* finishStream removes a completed stream.
@@ -306,9 +621,16 @@ func (c *Connection) finishStream(s *stream, err error) {
 		c.finishStream(a, err)
 	}
 
+	// Once the remote has finished sending, whatever is left in the
+	// buffer can still be read through to a clean EOF, eg when the socket
+	// is closed after a GO_AWAY before the user has read the response.
 	s.rxLock.Lock()
-	s.rxError = err
+	if !s.rxFinished {
+		s.rxError = err
+		s.rxBuffer.Reset()
+	}
 	s.rxCond.Broadcast()
+	c.releaseWindow(s)
 	s.rxLock.Unlock()
 
 	s.txLock.Lock()
@@ -317,6 +639,14 @@ func (c *Connection) finishStream(s *stream, err error) {
 	s.txLock.Unlock()
 
 	close(s.txErrorChannel)
+	s.wakeContinue()
+
+	if s.timeoutTimer != nil {
+		s.timeoutTimer.Stop()
+	}
+	if s.cancel != nil {
+		s.cancel()
+	}
 
 	// Remove ourself from our parent
 	if s.parent != nil {
@@ -330,7 +660,7 @@ func (c *Connection) finishStream(s *stream, err error) {
 	}
 
 	if c.goAway && len(c.streams) == 0 {
-		c.socket.Close()
+		c.queueClose()
 	}
 }
 
@@ -344,6 +674,7 @@ func (c *Connection) sendReset(streamId int, reason int) {
 
 func (c *Connection) handleStartRequest(s *stream) error {
 	s.streamId = c.nextStreamId
+	s.txWindow = c.txWindow
 	c.nextStreamId += 2
 
 	assocId := 0
@@ -358,19 +689,31 @@ func (c *Connection) handleStartRequest(s *stream) error {
 	// note we always use the control channel to ensure that the
 	// SYN_STREAM packets are sent out in the order in which the stream
 	// ids were allocated
-	c.sendControl <- &synStreamFrame{
+	f := &synStreamFrame{
 		Version:            c.version,
 		StreamId:           s.streamId,
 		AssociatedStreamId: assocId,
 		Finished:           s.txFinished,
 		Unidirectional:     s.rxFinished,
-		Header:             s.request.Header,
 		Priority:           s.txPriority,
-		URL:                s.request.URL,
-		Proto:              s.request.Proto,
-		Method:             s.request.Method,
 	}
 
+	if s.raw {
+		f.Raw = true
+		f.Header = s.rawHeader
+	} else {
+		f.Header = s.request.Header
+		if s.rxContinue != nil {
+			f.Header = f.Header.Clone()
+			f.Header.Set(continueHeader, "1")
+		}
+		f.URL = s.request.URL
+		f.Proto = s.request.Proto
+		f.Method = s.request.Method
+	}
+
+	c.sendControl <- f
+
 	// unidirectional and immediate finish messages never
 	// get added to the streams table and will shortly be gc'd
 	if s.txFinished && s.rxFinished {
@@ -393,8 +736,127 @@ func handlerFinish(s *stream) {
 		log.Print(buf.String())
 	}
 
+	if s.cancel != nil {
+		s.cancel()
+	}
+
+	// Hijacked streams are finished by closing the conn
+	if s.hijacked {
+		return
+	}
+
 	s.closeTx()
-	s.connection.onStreamFinished <- s
+	select {
+	case s.connection.onStreamFinished <- s:
+	case <-s.connection.closed:
+	}
+}
+
+// startTimeouts arms the timer for the server timeouts of a stream that we
+// are handling.
+func (c *Connection) startTimeouts(s *stream) {
+	t := c.timeouts
+	first := t.Data
+	for _, d := range []time.Duration{t.Body, t.Write} {
+		if first <= 0 || (d > 0 && d < first) {
+			first = d
+		}
+	}
+
+	if first <= 0 {
+		return
+	}
+
+	s.rxStarted = time.Now()
+	s.rxLastData = s.rxStarted
+	s.timeoutTimer = time.AfterFunc(first, func() {
+		select {
+		case c.onStreamTimeout <- s:
+		case <-c.closed:
+		}
+	})
+}
+
+// checkTimeouts resets a stream if the remote has taken too long to send
+// the request or to let us send the response. Otherwise it rearms the timer
+// for the next time that the stream could time out.
+func (c *Connection) checkTimeouts(s *stream) {
+	if c.streams[s.streamId] != s {
+		return
+	}
+
+	s.txLock.Lock()
+	hijacked := s.txHijacked
+	stalled := s.txStalled
+	waiting := s.txContinue // the remote waits for a 100 Continue
+	s.txLock.Unlock()
+
+	// Hijacked streams use deadlines on the conn instead
+	if hijacked {
+		return
+	}
+
+	t := c.timeouts
+	now := time.Now()
+	var next time.Time
+	expired := false
+
+	check := func(deadline time.Time) {
+		if !now.Before(deadline) {
+			expired = true
+		} else if next.IsZero() || deadline.Before(next) {
+			next = deadline
+		}
+	}
+
+	if !s.rxFinished {
+		if t.Body > 0 {
+			check(s.rxStarted.Add(t.Body))
+		}
+
+		if t.Data > 0 {
+			// The remote can't send any more until the handler reads.
+			// We don't know when that happened since the last check,
+			// so the gap starts again from now.
+			s.rxLock.Lock()
+			waiting = waiting || s.rxWindow <= 0
+			s.rxLock.Unlock()
+
+			if waiting || s.rxHeldUp {
+				s.rxLastData = now
+			}
+			s.rxHeldUp = waiting
+			check(s.rxLastData.Add(t.Data))
+		}
+	}
+
+	if t.Write > 0 {
+		if stalled.IsZero() {
+			stalled = now
+		}
+		check(stalled.Add(t.Write))
+	}
+
+	if expired {
+		log.Printf("spdy: stream %d timed out", s.streamId)
+
+		// Don't wait on a remote that isn't reading
+		select {
+		case c.sendControl <- &rstStreamFrame{
+			Version:  c.version,
+			StreamId: s.streamId,
+			Reason:   rstCancel,
+		}:
+		default:
+		}
+
+		c.finishStream(s, ErrStreamTimeout(s.streamId))
+		return
+	}
+
+	if !next.IsZero() {
+		s.timeoutTimer.Reset(next.Sub(now))
+	}
 }
 
 func handlerThread(h http.Handler, s *stream, req *http.Request) {
@@ -421,6 +883,12 @@ func (c *Connection) handleSynStream(d []byte, unzip *decompressor) error {
 		return ErrStreamVersion{f.StreamId, f.Version}
 	}
 
+	// We have already told the remote to go away, so don't start any new
+	// streams.
+	if c.goAway {
+		return ErrRefusedStream(f.StreamId)
+	}
+
 	// The remote tried to open a stream of the wrong type (eg its a
 	// client and tried to open a server stream).
 	if (f.StreamId & 1) == (c.nextStreamId & 1) {
@@ -433,6 +901,10 @@ func (c *Connection) handleSynStream(d []byte, unzip *decompressor) error {
 	}
 	c.lastStreamOpened = f.StreamId
 
+	if f.Raw {
+		return c.handleRawStream(f)
+	}
+
 	// The handler is either the connection global one or the associated
 	// stream one.
 	handler := c.handler
@@ -461,7 +933,11 @@ func (c *Connection) handleSynStream(d []byte, unzip *decompressor) error {
 	// The SYN_STREAM passed all of our tests, so go ahead and create the
 	// stream, hook it up and start a request handler thread.
 
-	r := &http.Request{
+	// The handler's context is cancelled once it returns or the stream is
+	// finished, whichever is first.
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), connectionKey{}, c))
+
+	r := (&http.Request{
 		Method:     f.Method,
 		URL:        f.URL,
 		Proto:      f.Proto,
@@ -471,10 +947,13 @@ func (c *Connection) handleSynStream(d []byte, unzip *decompressor) error {
 		Host:       f.URL.Host,
 		RemoteAddr: c.remoteAddr.String(),
 		TLS:        c.tls,
-	}
+	}).WithContext(ctx)
 
-	if cl, err := strconv.ParseInt(f.Header.Get("Content-Length"), 10, 64); err != nil {
+	if cl, err := strconv.ParseInt(f.Header.Get("Content-Length"), 10, 64); err == nil {
 		r.ContentLength = cl
+	} else if !f.Finished {
+		// There is a body but we don't know how long it is
+		r.ContentLength = -1
 	}
 
 	extra := &RequestExtra{
@@ -486,13 +965,19 @@ func (c *Connection) handleSynStream(d []byte, unzip *decompressor) error {
 
 	s := c.newStream(r, f.Unidirectional, extra)
 	s.streamId = f.StreamId
+	s.txWindow = c.txWindow
+	c.initReceiveWindow(s)
 	s.isRecipient = true
 	s.request.Body = (*streamRxUser)(s)
+	interim := popHeader(f.Header, continueHeader) != ""
+	s.txContinue = interim && !f.Finished && expectsContinue(f.Header)
+	s.cancel = cancel
 
 	// Messages that have both their rx and tx pipes already closed don't
 	// need to be added to the streams table.
 	if !(s.txFinished && s.rxFinished) {
 		c.streams[f.StreamId] = s
+		c.startTimeouts(s)
 
 		if parent != nil {
 			parent.children = append(parent.children, s)
@@ -529,6 +1014,10 @@ func (c *Connection) handleSynReply(d []byte, unzip *decompressor) error {
 		return ErrStreamAlreadyClosed(f.StreamId)
 	}
 
+	if s.raw != f.Raw {
+		return ErrStreamProtocol(f.StreamId)
+	}
+
 	r := &http.Response{
 		Status:     f.Status,
 		Proto:      f.Proto,
@@ -539,13 +1028,16 @@ func (c *Connection) handleSynReply(d []byte, unzip *decompressor) error {
 		Request:    s.request,
 	}
 
-	split := strings.SplitN(f.Status, " ", 2)
-	if len(split) < 2 {
-		return ErrStreamProtocol(f.StreamId)
-	}
+	// Raw streams only carry the reply headers
+	if !f.Raw {
+		split := strings.SplitN(f.Status, " ", 2)
+		if len(split) < 2 {
+			return ErrStreamProtocol(f.StreamId)
+		}
 
-	if r.StatusCode, err = strconv.Atoi(split[0]); err != nil {
-		return ErrStreamProtocol(f.StreamId)
+		if r.StatusCode, err = strconv.Atoi(split[0]); err != nil {
+			return ErrStreamProtocol(f.StreamId)
+		}
 	}
 
 	if cl, err := strconv.ParseInt(f.Header.Get("Content-Length"), 10, 64); err == nil {
@@ -558,6 +1050,7 @@ func (c *Connection) handleSynReply(d []byte, unzip *decompressor) error {
 	s.rxCond.Broadcast()
 	s.rxLock.Unlock()
 
+	s.wakeContinue()
 	return nil
 }
 
@@ -582,6 +1075,14 @@ func (c *Connection) handleHeaders(d []byte, unzip *decompressor) error {
 		return ErrStreamAlreadyClosed(f.StreamId)
 	}
 
+	// Interim responses come in a HEADERS frame before the SYN_REPLY
+	if !s.isRecipient && s.rxResponse == nil && strings.HasPrefix(f.Status, "100") {
+		s.rxLock.Lock()
+		s.rxContinued = true
+		s.rxLock.Unlock()
+		s.wakeContinue()
+	}
+
 	if f.Finished {
 		s.rxLock.Lock()
 		s.rxFinished = f.Finished
@@ -599,6 +1100,11 @@ func (c *Connection) handleRstStream(d []byte) error {
 
 	log.Printf("spdy: rx RST_STREAM %+v", f)
 
+	if !c.rxResets.allow(c.rxLimits.Resets, c.rxLimits.Interval) {
+		c.closeSession(ErrRateLimit("RST_STREAM"), rstProtocolError)
+		return nil
+	}
+
 	s := c.streams[f.StreamId]
 	if s == nil {
 		// ignore resets for closed streams
@@ -623,6 +1129,13 @@ func (c *Connection) handleRstStream(d []byte) error {
 		err = ErrStreamAlreadyClosed(f.StreamId)
 	}
 
+	// The remote opened the stream and then cancelled it before we
+	// finished, leaving us to clean up after the handler.
+	if s.isRecipient && !c.rxResetStreams.allow(c.rxLimits.ResetStreams, c.rxLimits.Interval) {
+		c.closeSession(ErrRateLimit("SYN_STREAM"), rstProtocolError)
+		return nil
+	}
+
 	// Don't return an error and handle the error locally since we don't
 	// want to send a RST_STREAM
 	c.finishStream(s, err)
@@ -641,12 +1154,17 @@ func (c *Connection) handleSettings(d []byte) error {
 		return ErrSessionVersion(f.Version)
 	}
 
+	if !c.rxSettings.allow(c.rxLimits.Settings, c.rxLimits.Interval) {
+		c.closeSession(ErrRateLimit("SETTINGS"), rstProtocolError)
+		return nil
+	}
+
 	if !f.HaveWindow {
 		return nil
 	}
 
-	change := f.Window - c.rxWindow
-	c.rxWindow = f.Window
+	change := f.Window - c.txWindow
+	c.txWindow = f.Window
 
 	for _, s := range c.streams {
 		s.txLock.Lock()
@@ -664,11 +1182,15 @@ func (c *Connection) handleWindowUpdate(d []byte) error {
 		return err
 	}
 
-	log.Printf("spdy: rx WINDOW_UPDATE %+v", f)
+	if LogDataFrames {
+		log.Printf("spdy: rx WINDOW_UPDATE %+v", f)
+	}
 
 	s := c.streams[f.StreamId]
 	if s == nil {
-		return ErrInvalidStream(f.StreamId)
+		// The remote may send updates for data it read before it
+		// saw us finish the stream.
+		return nil
 	}
 
 	if f.Version != c.version {
@@ -695,12 +1217,26 @@ func (c *Connection) handlePing(d []byte) error {
 		return ErrSessionVersion(f.Version)
 	}
 
-	// Ignore loopback pings
+	// Ignore loopback pings other than the one measuring the round trip
 	if (f.Id & 1) != (c.nextPingId & 1) {
-		c.sendControl <- &pingFrame{
+		if !c.rxPings.allow(c.rxLimits.Pings, c.rxLimits.Interval) {
+			c.closeSession(ErrRateLimit("PING"), rstProtocolError)
+			return nil
+		}
+
+		// Drop the reply rather than block if the remote isn't reading
+		// them.
+		select {
+		case c.sendControl <- &pingFrame{
 			Version: c.version,
 			Id:      f.Id,
+		}:
+		default:
 		}
+	} else if f.Id == c.rttPingId && !c.rttPingSent.IsZero() {
+		atomic.StoreInt64(&c.rtt, int64(time.Since(c.rttPingSent)))
+		c.rttPingSent = time.Time{}
+		c.ackReceiveWindow()
 	}
 
 	return nil
@@ -721,38 +1257,39 @@ func (c *Connection) handleGoAway(d []byte) error {
 	// This is so we don't start any streams after this point, and
 	// finishStream will detect once we've finished all the active streams
 	// and shut down the socket.
-	c.goAway = true
-	close(c.onGoAway)
+	c.setGoAway()
 
+	// Reset all streams that we started which are after the last accepted
+	// stream. Whatever the reason, the remote never processed these so
+	// they all get ErrGoAway to let the client know that they can be
+	// retried.
 	for id, s := range c.streams {
-		err := ErrSessionProtocol
-
-		switch f.Reason {
-		case rstSuccess:
-			err = ErrGoAway
-		case rstUnsupportedVersion:
-			err = ErrSessionVersion(c.version)
-		case rstFlowControlError:
-			err = ErrSessionFlowControl
-		}
-
-		// Reset all streams that we started which are after the last
-		// accepted stream
 		if id > f.LastStreamId && (id&1) == (c.nextStreamId&1) {
-			c.finishStream(s, err)
+			c.finishStream(s, ErrGoAway)
 		}
 	}
 
 	return nil
 }
 
+// handleData queues the payload on the stream. It takes ownership of the rx
+// buffer d.
 func (c *Connection) handleData(d []byte) error {
-	f, err := parseData(d)
-	if err != nil {
+	queued := false
+	defer func() {
+		if !queued {
+			releaseRxBuffer(d)
+		}
+	}()
+
+	f := &c.rxFrame
+	if err := parseData(d, f); err != nil {
 		return err
 	}
 
-	log.Printf("spdy: rx DATA %+v", f)
+	if LogDataFrames {
+		log.Printf("spdy: rx DATA %v", f)
+	}
 
 	s := c.streams[f.StreamId]
 	if s == nil {
@@ -763,12 +1300,6 @@ func (c *Connection) handleData(d []byte) error {
 		return ErrStreamAlreadyClosed(f.StreamId)
 	}
 
-	// The rx pump thread could not give us the entire message due to it
-	// being too large.
-	if length := int(fromBig32(d[4:]) & 0xFFFFFF); length != len(f.Data) {
-		return ErrStreamFlowControl(f.StreamId)
-	}
-
 	// Streams are not allowed to change from compress to non-compress mid
 	// way through
 	if s.rxHaveData && s.rxCompressed != f.Compressed {
@@ -776,17 +1307,61 @@ func (c *Connection) handleData(d []byte) error {
 	}
 
 	s.rxHaveData = true
+	if c.timeouts.Data > 0 {
+		s.rxLastData = time.Now()
+	}
 
 	s.rxLock.Lock()
+	defer s.rxLock.Unlock()
+
+	// The remote has ignored our window. As the window is only reopened
+	// as the user reads, this also caps how much we buffer. V2 has no
+	// flow control.
+	if c.version >= 3 {
+		if len(f.Data) > s.rxWindow {
+			return ErrStreamFlowControl(f.StreamId)
+		}
+		s.rxWindow -= len(f.Data)
+	}
+
 	s.rxCompressed = f.Compressed
-	s.rxBuffer.Write(f.Data)
+	s.rxBuffer.Push(d, f.Data)
+	queued = true
 	s.rxFinished = f.Finished
 	s.rxCond.Broadcast()
-	s.rxLock.Unlock()
 
 	return nil
 }
 
+// handleFrameTooLarge rejects a control frame that was over the size limit,
+// of which the rx thread only gave us the start. Frames for a stream reset it
+// with FRAME_TOO_LARGE, and those carrying a header block also close the
+// session as the header compression state is lost. Anything else is a
+// session error.
+func (c *Connection) handleFrameTooLarge(d []byte) error {
+	if len(d) < 12 {
+		return ErrSessionProtocol
+	}
+
+	sid := int(fromBig32(d[8:]) & 0x7FFFFFFF)
+
+	switch fromBig32(d[0:]) & 0x8000FFFF {
+	case synStreamCode, synReplyCode, headersCode:
+		// We never decompressed the header block, so our compression
+		// state no longer matches the remote's and the session can't
+		// carry on.
+		c.sendReset(sid, rstFrameTooLarge)
+		c.closeSession(ErrFrameTooLarge(sid), rstProtocolError)
+		return nil
+
+	case rstStreamCode, windowUpdateCode:
+		return ErrFrameTooLarge(sid)
+	}
+
+	return ErrSessionFrameTooLarge
+}
+
+// handleFrame handles a frame from the rx thread and releases its buffer.
 func (c *Connection) handleFrame(d []byte, unzip *decompressor) error {
 	code := fromBig32(d[0:])
 
@@ -794,8 +1369,10 @@ func (c *Connection) handleFrame(d []byte, unzip *decompressor) error {
 		return c.handleData(d)
 	}
 
+	defer releaseRxBuffer(d)
+
 	if length := int(fromBig32(d[4:]) & 0xFFFFFF); length+8 != len(d) {
-		return ErrSessionFlowControl
+		return c.handleFrameTooLarge(d)
 	}
 
 	switch code & 0x8000FFFF {
@@ -840,20 +1417,35 @@ func (c *Connection) handleFrame(d []byte, unzip *decompressor) error {
 // The connection won't be started until you run Connection.Run()
 func NewConnection(sock net.Conn, handler http.Handler, version int, server bool) *Connection {
 	c := &Connection{
-		socket:           sock,
-		version:          version,
-		handler:          handler,
-		remoteAddr:       sock.RemoteAddr(),
-		rxWindow:         defaultWindow,
-		sendControl:      make(chan frame, 100),
-		sendWindowUpdate: make(chan frame, 100),
-		dataSent:         make(chan error),
-		onStartRequest:   make(chan *stream),
-		onRequestStarted: make(chan error),
-		onStreamFinished: make(chan *stream),
-		streams:          make(map[int]*stream),
-		lastStreamOpened: 0,
-		onGoAway:         make(chan bool),
+		socket:            sock,
+		version:           version,
+		handler:           handler,
+		remoteAddr:        sock.RemoteAddr(),
+		rxWindow:          defaultWindow,
+		rxWindowAcked:     true,
+		txWindow:          defaultWindow,
+		rxUpdateFraction:  DefaultWindowUpdateFraction,
+		rxUpdateDelay:     DefaultWindowUpdateDelay,
+		rxMaxControlFrame: DefaultMaxControlFrameSize,
+		txHeaderLevel:     compressionLevel,
+		txSensitive:       headerSet(DefaultSensitiveHeaders),
+		rxLimits:          DefaultRateLimits,
+		sendControl:       make(chan frame, 100),
+		sendWindowUpdate:  make(chan frame, 100),
+		onStartRequest:    make(chan *stream),
+		onRequestStarted:  make(chan error),
+		onStreamFinished:  make(chan *stream),
+		onStreamReset:     make(chan *stream),
+		onStreamTimeout:   make(chan *stream),
+		accepted:          make(chan *stream, maxPendingStreams),
+		streams:           make(map[int]*stream),
+		lastStreamOpened:  0,
+		onGoAway:          make(chan bool),
+		onShutdown:        make(chan bool),
+		onShutdownDone:    make(chan bool),
+		onNumStreams:      make(chan bool),
+		numStreams:        make(chan int),
+		closed:            make(chan bool),
 	}
 
 	for i := 0; i < len(c.sendData); i++ {
@@ -870,3 +1462,330 @@ func NewConnection(sock net.Conn, handler http.Handler, version int, server bool
 
 	return c
 }
+
+type connectionKey struct{}
+
+// ConnectionFromRequest returns the connection that a request being handled
+// was received on, so that the handler can start requests or streams back
+// toward the remote. It returns nil for requests that didn't come in over
+// SPDY.
+func ConnectionFromRequest(r *http.Request) *Connection {
+	c, _ := r.Context().Value(connectionKey{}).(*Connection)
+	return c
+}
+
+// RoundTrip sends a request to the remote outside of any associated stream,
+// eg for a server to call back into a client that set
+// Transport.ServerRequestHandler. Unlike Transport it does not retry or
+// decode the response.
+func (c *Connection) RoundTrip(req *http.Request) (*http.Response, error) {
+	out := *req
+	resp, err := c.startRequest(nil, &out, nil)
+	if resp != nil {
+		resp.Request = req
+	}
+	return resp, err
+}
+
+// SetReceiveWindow sets the per stream flow control window that the remote
+// may send before waiting for us to read, which also bounds how much data
+// is buffered for each stream. It must be called before Run, which announces
+// it to the remote. The default is 64KB. A remote that overruns the window
+// has its stream reset with FLOW_CONTROL_ERROR. Streams that the remote opens
+// before it has seen the announcement start with the default window.
+//
+// SPDY/2 has no flow control so this has no effect.
+func (c *Connection) SetReceiveWindow(size int) {
+	c.rxWindow = size
+}
+
+// DefaultMaxControlFrameSize is the default for SetMaxControlFrameSize.
+const DefaultMaxControlFrameSize = 64 * 1024
+
+// SetMaxControlFrameSize limits the length of control frames that we
+// accept, which mostly bounds the size of compressed header blocks. Streams
+// whose SYN_STREAM, SYN_REPLY or HEADERS are over the limit are reset with
+// FRAME_TOO_LARGE. The header compression state is then lost, so the
+// session is closed as well. DATA frames can be of any size. It must be
+// called before Run.
+func (c *Connection) SetMaxControlFrameSize(size int) {
+	c.rxMaxControlFrame = size
+}
+
+// SetHeaderCompression sets the zlib compression level, from
+// zlib.NoCompression to zlib.BestCompression, used for the headers that we
+// send. The default is zlib.BestCompression. It must be called before Run.
+func (c *Connection) SetHeaderCompression(level int) {
+	if level < zlib.DefaultCompression || level > zlib.BestCompression {
+		level = compressionLevel
+	}
+	c.txHeaderLevel = level
+}
+
+// RateLimits caps how often the remote may send frames that make us do
+// work without making progress on any stream. Each limit is how many of
+// those frames are allowed in each Interval, with zero being unlimited. A
+// remote that goes over a limit is sent a GO_AWAY and the connection is
+// closed.
+type RateLimits struct {
+	Interval time.Duration
+
+	Pings    int // PINGs that we have to reply to
+	Settings int // SETTINGS
+	Resets   int // RST_STREAMs, including those for closed streams
+
+	// ResetStreams counts streams that the remote opened and then reset
+	// before we had finished them.
+	ResetStreams int
+}
+
+// DefaultRateLimits is the default for SetRateLimits.
+var DefaultRateLimits = RateLimits{
+	Interval:     time.Second,
+	Pings:        50,
+	Settings:     50,
+	Resets:       1000,
+	ResetStreams: 500,
+}
+
+// SetRateLimits sets the limits on frames from the remote. It must be called
+// before Run.
+func (c *Connection) SetRateLimits(limits RateLimits) {
+	c.rxLimits = limits
+}
+
+// rateCounter counts frames received in fixed windows of time.
+type rateCounter struct {
+	start time.Time
+	count int
+}
+
+// allow counts a frame and reports whether it is within limit frames per
+// interval.
+func (r *rateCounter) allow(limit int, interval time.Duration) bool {
+	if limit <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	if now.Sub(r.start) >= interval {
+		r.start = now
+		r.count = 0
+	}
+
+	r.count++
+	return r.count <= limit
+}
+
+// Timeouts limit how long the remote may take over the requests that we
+// handle, so that slow clients can't hold on to streams and handler
+// goroutines. Streams that take too long are reset and the handler's
+// context is cancelled. Zero durations have no limit.
+type Timeouts struct {
+	// Header limits how long a control frame, such as the SYN_STREAM
+	// carrying a request's headers, may take to arrive once it has
+	// started. The connection is closed if it doesn't.
+	Header time.Duration
+
+	// Data limits the gap between the DATA frames of a request body,
+	// not counting the time that the remote is waiting for the handler
+	// to read.
+	Data time.Duration
+
+	// Body limits how long the whole request body may take to arrive.
+	Body time.Duration
+
+	// Write limits how long a response write may be blocked, whether
+	// waiting for the remote to open up the flow control window or for
+	// the connection's tx queue.
+	Write time.Duration
+}
+
+// SetTimeouts sets the timeouts for requests from the remote. It must be
+// called before Run.
+func (c *Connection) SetTimeouts(t Timeouts) {
+	c.timeouts = t
+}
+
+// DefaultSensitiveHeaders is the default for SetSensitiveHeaders.
+var DefaultSensitiveHeaders = []string{
+	"Authorization",
+	"Cookie",
+	"Proxy-Authorization",
+	"Set-Cookie",
+}
+
+// SetSensitiveHeaders sets the headers whose values are kept out of the
+// header compression context. They are sent uncompressed and never used
+// to compress later headers, so that they can't be found from the size of
+// frames that also carry headers chosen by an attacker (CRIME). An empty
+// list compresses all headers. It must be called before Run.
+func (c *Connection) SetSensitiveHeaders(keys []string) {
+	c.txSensitive = headerSet(keys)
+}
+
+func headerSet(keys []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, key := range keys {
+		set[http.CanonicalHeaderKey(key)] = true
+	}
+	return set
+}
+
+// Defaults for SetWindowUpdate.
+const (
+	DefaultWindowUpdateFraction = 0.5
+	DefaultWindowUpdateDelay    = 10 * time.Millisecond
+)
+
+// SetWindowUpdate sets how often WINDOW_UPDATEs are sent as stream data is
+// read. Updates are held back until fraction of the receive window has
+// been read, or until delay has passed since the first read after the last
+// update. A fraction outside (0, 1] uses DefaultWindowUpdateFraction and a
+// negative delay only sends updates once the fraction is reached. It must be
+// called before Run.
+func (c *Connection) SetWindowUpdate(fraction float64, delay time.Duration) {
+	if fraction <= 0 || fraction > 1 {
+		fraction = DefaultWindowUpdateFraction
+	}
+	c.rxUpdateFraction = fraction
+	c.rxUpdateDelay = delay
+}
+
+// rxUpdateThreshold is how much stream data is read before sending a
+// WINDOW_UPDATE for a window of the given size.
+func (c *Connection) rxUpdateThreshold(window int) int {
+	if n := int(float64(window) * c.rxUpdateFraction); n > 0 {
+		return n
+	}
+	return 1
+}
+
+// SetAutoTuneBudget enables growing stream receive windows beyond the
+// initial size when the remote is sending faster than the round trip allows
+// the window to be reopened. Budget is how much the windows of all streams
+// on the connection may grow by in total, and so bounds the extra memory
+// used for buffering. Zero, the default, disables auto-tuning. It must be
+// called before Run.
+func (c *Connection) SetAutoTuneBudget(budget int) {
+	c.rxBudget = budget
+}
+
+// roundTripTime returns the round trip time measured with a PING, or zero
+// if it's not yet known.
+func (c *Connection) roundTripTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.rtt))
+}
+
+// reserveWindow takes up to want bytes from the auto-tuning budget.
+func (c *Connection) reserveWindow(want int) int {
+	for {
+		used := atomic.LoadInt64(&c.rxBudgetUsed)
+		if avail := int64(c.rxBudget) - used; int64(want) > avail {
+			want = int(avail)
+		}
+		if want <= 0 {
+			return 0
+		}
+		if atomic.CompareAndSwapInt64(&c.rxBudgetUsed, used, used+int64(want)) {
+			return want
+		}
+	}
+}
+
+// releaseWindow returns a finished stream's window growth to the budget.
+// The stream's rxLock must be held.
+func (c *Connection) releaseWindow(s *stream) {
+	atomic.AddInt64(&c.rxBudgetUsed, -int64(s.rxGrown))
+	s.rxGrown = 0
+}
+
+// initReceiveWindow sets up the window of a stream opened by the remote. If
+// the remote hasn't yet seen our SETTINGS then it will be using the default
+// window until it does. We allow for whichever window is larger as frames
+// sent before and after the remote sees the change can arrive either side
+// of our PING reply.
+func (c *Connection) initReceiveWindow(s *stream) {
+	if !c.rxWindowAcked {
+		s.rxWindowSize = defaultWindow
+		if c.rxWindow < defaultWindow {
+			s.rxWindow = defaultWindow
+		}
+	}
+}
+
+// ackReceiveWindow is called once the remote has seen our SETTINGS. Like the
+// remote we then resize the windows of the streams it opened earlier, so
+// that WINDOW_UPDATEs are sent for the window the remote is using. A larger
+// window was already allowed for by initReceiveWindow, but a smaller one
+// only now applies.
+func (c *Connection) ackReceiveWindow() {
+	if c.rxWindowAcked {
+		return
+	}
+	c.rxWindowAcked = true
+
+	change := c.rxWindow - defaultWindow
+	for _, s := range c.streams {
+		if s.isRecipient {
+			s.rxLock.Lock()
+			if change < 0 {
+				s.rxWindow += change
+			}
+			s.rxWindowSize += change
+			s.rxLock.Unlock()
+		}
+	}
+}
+
+// Version returns the SPDY version spoken on the connection.
+func (c *Connection) Version() int {
+	return c.version
+}
+
+// NumStreams returns the number of currently active streams. It returns 0
+// once the connection has closed.
+func (c *Connection) NumStreams() int {
+	select {
+	case <-c.closed:
+		return 0
+	case c.onNumStreams <- true:
+	}
+
+	return <-c.numStreams
+}
+
+// GoAway sends a GO_AWAY to the remote so that no new streams are started on
+// the connection. Active streams are left to finish after which the
+// connection is closed.
+func (c *Connection) GoAway() {
+	select {
+	case <-c.closed:
+	case c.onShutdown <- false:
+		<-c.onShutdownDone
+	}
+}
+
+// CloseIfIdle is similar to GoAway but only shuts the connection down if
+// there are no active streams. It returns whether the connection is now
+// shutting down.
+func (c *Connection) CloseIfIdle() bool {
+	select {
+	case <-c.closed:
+		return true
+	case c.onShutdown <- true:
+	}
+
+	return <-c.onShutdownDone
+}
+
+// Close immediately closes the underlying socket aborting any active streams.
+func (c *Connection) Close() error {
+	return c.socket.Close()
+}
+
+// Closed returns a channel that is closed once the connection has finished
+// running.
+func (c *Connection) Closed() <-chan bool {
+	return c.closed
+}
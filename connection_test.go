@@ -0,0 +1,924 @@
+package spdy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// readFrame reads a whole frame, including its header, from a raw peer.
+func readFrame(t *testing.T, r io.Reader) []byte {
+	h := make([]byte, 8)
+	if _, err := io.ReadFull(r, h); err != nil {
+		t.Fatal(err)
+	}
+	d := make([]byte, 8+fromBig32(h[4:])&0xFFFFFF)
+	copy(d, h)
+	if _, err := io.ReadFull(r, d[8:]); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// frameCode returns the control bit and type of a frame, for comparing
+// against the codes such as rstStreamCode.
+func frameCode(d []byte) uint32 {
+	return fromBig32(d) & 0x8000FFFF
+}
+
+// ackSettings reads the window announced by a connection and replies to the
+// PING that follows it, returning the window.
+func ackSettings(t *testing.T, rw io.ReadWriter) int {
+	f, err := parseSettings(readFrame(t, rw))
+	if err != nil || !f.HaveWindow {
+		t.Fatalf("expected the window in SETTINGS, got %+v %v", f, err)
+	}
+
+	ping, err := parsePing(readFrame(t, rw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ping.WriteFrame(rw, nil)
+	return f.Window
+}
+
+func TestReceiveWindow(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+
+	c := NewConnection(b, nil, 3, true)
+	c.SetReceiveWindow(1000)
+	c.SetAcceptStreams(true)
+	go c.Run()
+
+	// The window is announced up front
+	if window := ackSettings(t, a); window != 1000 {
+		t.Fatalf("expected the window in SETTINGS, got %d", window)
+	}
+
+	syn := &synStreamFrame{Version: 3, StreamId: 1, Raw: true}
+	if err := syn.WriteFrame(a, new(compressor)); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := c.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fill the window without the stream being read
+	(&dataFrame{StreamId: 1, Data: make([]byte, 600)}).WriteFrame(a, nil)
+	(&dataFrame{StreamId: 1, Data: make([]byte, 400)}).WriteFrame(a, nil)
+
+	// And overrun it
+	go (&dataFrame{StreamId: 1, Data: make([]byte, 1)}).WriteFrame(a, nil)
+
+	d := readFrame(t, a)
+	if fromBig32(d)&0x8000FFFF != rstStreamCode {
+		t.Fatalf("expected a RST_STREAM, got %x", d)
+	}
+	if rst, _ := parseRstStream(d); rst.StreamId != 1 || rst.Reason != rstFlowControlError {
+		t.Fatalf("expected a flow control error, got %+v", rst)
+	}
+
+	if _, err := s.Read(make([]byte, 1)); err != ErrStreamFlowControl(1) {
+		t.Fatalf("expected a flow control error, got %v", err)
+	}
+}
+
+func TestReceiveWindowBeforeAck(t *testing.T) {
+	for _, test := range []struct {
+		window     int
+		before     int
+		after      int
+		overrunErr bool
+	}{
+		// Data sent once the remote has seen a larger window may
+		// arrive before the PING reply.
+		{window: 100000, before: 80000, after: 20000},
+		// While a smaller window only applies after the reply.
+		{window: 1000, before: 500, after: 501, overrunErr: true},
+	} {
+		a, b := net.Pipe()
+		block := make(chan bool)
+
+		c := NewConnection(b, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-block
+		}), 3, true)
+		c.SetReceiveWindow(test.window)
+		go c.Run()
+
+		// Hold back the reply to the PING that follows the SETTINGS
+		readFrame(t, a)
+		ping, err := parsePing(readFrame(t, a))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		syn := &synStreamFrame{
+			Version:    3,
+			StreamId:   1,
+			URL:        testurl,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Method:     "POST",
+		}
+		if err := syn.WriteFrame(a, new(compressor)); err != nil {
+			t.Fatal(err)
+		}
+
+		send := func(n int) {
+			for ; n > 0; n -= 10000 {
+				size := n
+				if size > 10000 {
+					size = 10000
+				}
+				(&dataFrame{StreamId: 1, Data: make([]byte, size)}).WriteFrame(a, nil)
+			}
+		}
+
+		// The PING after the reply makes sure it has been handled
+		// before any more data is sent.
+		send(test.before)
+		ping.WriteFrame(a, nil)
+		(&pingFrame{Version: 3, Id: 1}).WriteFrame(a, nil)
+		if d := readFrame(t, a); fromBig32(d)&0x8000FFFF != pingCode {
+			t.Fatalf("window %d: expected a PING, got %x", test.window, d)
+		}
+
+		go func() {
+			send(test.after)
+			(&pingFrame{Version: 3, Id: 3}).WriteFrame(a, nil)
+		}()
+
+		d := readFrame(t, a)
+		if test.overrunErr {
+			if rst, err := parseRstStream(d); err != nil || rst.Reason != rstFlowControlError {
+				t.Fatalf("window %d: expected a flow control error, got %x", test.window, d)
+			}
+		} else if fromBig32(d)&0x8000FFFF != pingCode {
+			t.Fatalf("window %d: expected a PING, got %x", test.window, d)
+		}
+
+		close(block)
+		a.Close()
+	}
+}
+
+func TestSmallReceiveWindow(t *testing.T) {
+	a, b := net.Pipe()
+	client := NewConnection(a, nil, 3, false)
+	server := NewConnection(b, nil, 3, true)
+	client.SetReceiveWindow(100)
+	server.SetReceiveWindow(1000)
+	server.SetAcceptStreams(true)
+	go client.Run()
+	go server.Run()
+	defer client.Close()
+
+	// Wait for both SETTINGS to have been processed
+	s1, err := client.OpenStream(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2.Reply(nil)
+	if _, err := s1.ReplyHeader(); err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	for _, p := range [][2]*RawStream{{s1, s2}, {s2, s1}} {
+		w, r := p[0], p[1]
+		go func() {
+			w.Write(data)
+			w.CloseWrite()
+		}()
+
+		if got, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("got %d bytes %v", len(got), err)
+		}
+	}
+}
+
+// openRawPeer starts a server connection on a pipe, configured by setup, and
+// opens a raw stream to it from the other end of the pipe which is returned
+// for the test to write frames to.
+func openRawPeer(t *testing.T, setup func(c *Connection)) (net.Conn, *RawStream) {
+	a, b := net.Pipe()
+	t.Cleanup(func() { a.Close() })
+
+	c := NewConnection(b, nil, 3, true)
+	c.SetAcceptStreams(true)
+	setup(c)
+	go c.Run()
+
+	if c.rxWindow != defaultWindow {
+		ackSettings(t, a)
+	}
+
+	syn := &synStreamFrame{Version: 3, StreamId: 1, Raw: true}
+	if err := syn.WriteFrame(a, new(compressor)); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := c.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, s
+}
+
+// readWindowUpdate reads data from s and then expects the next frame from
+// the connection to be a WINDOW_UPDATE, returning its delta.
+func readWindowUpdate(t *testing.T, peer net.Conn, s *RawStream, n int) int {
+	go (&dataFrame{StreamId: 1, Data: make([]byte, n)}).WriteFrame(peer, nil)
+	if _, err := io.ReadFull(s, make([]byte, n)); err != nil {
+		t.Fatal(err)
+	}
+
+	d := readFrame(t, peer)
+	f, err := parseWindowUpdate(d)
+	if err != nil {
+		t.Fatalf("expected a WINDOW_UPDATE, got %x %v", d, err)
+	}
+	return f.WindowDelta
+}
+
+func TestWindowUpdateCoalescing(t *testing.T) {
+	// Updates are only sent once half of the window has been read
+	peer, s := openRawPeer(t, func(c *Connection) {
+		c.SetReceiveWindow(1000)
+		c.SetWindowUpdate(0.5, -1)
+	})
+
+	for _, n := range []int{100, 300} {
+		(&dataFrame{StreamId: 1, Data: make([]byte, n)}).WriteFrame(peer, nil)
+		if _, err := io.ReadFull(s, make([]byte, n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if delta := readWindowUpdate(t, peer, s, 200); delta != 600 {
+		t.Fatalf("expected a single update for 600 bytes, got %d", delta)
+	}
+
+	// Smaller reads are given back after the delay
+	peer, s = openRawPeer(t, func(c *Connection) {
+		c.SetWindowUpdate(0.5, 10*time.Millisecond)
+	})
+
+	start := time.Now()
+	if delta := readWindowUpdate(t, peer, s, 10); delta != 10 {
+		t.Fatalf("expected an update for 10 bytes, got %d", delta)
+	}
+	if time.Since(start) < 10*time.Millisecond {
+		t.Fatal("update was sent before the delay")
+	}
+}
+
+func TestLargeDataFrame(t *testing.T) {
+	peer, s := openRawPeer(t, func(c *Connection) {
+		c.SetReceiveWindow(1 << 20)
+	})
+
+	// A single DATA frame much larger than our rx buffers
+	data := bytes.Repeat([]byte("0123456789"), 30000)
+	h := make([]byte, 8)
+	toBig32(h[0:], 1)
+	toBig32(h[4:], finishedFlag<<24|uint32(len(data)))
+
+	// The start of it can be read before the rest has been sent
+	go func() {
+		peer.Write(h)
+		peer.Write(data[:100000])
+	}()
+
+	got := make([]byte, 1000)
+	if _, err := io.ReadFull(s, got); err != nil {
+		t.Fatal(err)
+	}
+
+	go peer.Write(data[100000:])
+
+	rest, err := ioutil.ReadAll(s)
+	if err != nil || !bytes.Equal(append(got, rest...), data) {
+		t.Fatalf("got %d bytes %v", len(got)+len(rest), err)
+	}
+}
+
+func TestControlFrameTooLarge(t *testing.T) {
+	peer, sock := net.Pipe()
+	defer peer.Close()
+
+	c := NewConnection(sock, nil, 3, true)
+	c.SetMaxControlFrameSize(100)
+	go c.Run()
+
+	// Random headers don't compress under the limit
+	rnd := rand.New(rand.NewSource(1))
+	value := make([]byte, 200)
+	for i := range value {
+		value[i] = 'a' + byte(rnd.Intn(26))
+	}
+
+	syn := &synStreamFrame{
+		Version:  3,
+		StreamId: 3,
+		Raw:      true,
+		Header:   http.Header{"Big": {string(value)}},
+	}
+	go syn.WriteFrame(peer, new(compressor))
+
+	rst, err := parseRstStream(readFrame(t, peer))
+	if err != nil || rst.StreamId != 3 || rst.Reason != rstFrameTooLarge {
+		t.Fatalf("expected FRAME_TOO_LARGE, got %+v %v", rst, err)
+	}
+
+	// The header compression state is lost with the frame so the session
+	// is closed.
+	if _, err := parseGoAway(readFrame(t, peer)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the connection to close, got %v", err)
+	}
+}
+
+// floodPeer starts a server connection with the given limits and has the
+// peer write the frames from flood.
+func floodPeer(t *testing.T, limits RateLimits, flood func(w io.Writer)) net.Conn {
+	peer, sock := net.Pipe()
+	t.Cleanup(func() { peer.Close() })
+
+	c := NewConnection(sock, nil, 3, true)
+	c.SetRateLimits(limits)
+	c.SetAcceptStreams(true)
+	go c.Run()
+	go flood(peer)
+
+	return peer
+}
+
+// expectGoAway reads frames up to a GO_AWAY and then expects the connection
+// to close, returning the frames before the GO_AWAY.
+func expectGoAway(t *testing.T, peer net.Conn) [][]byte {
+	var frames [][]byte
+	for {
+		d := readFrame(t, peer)
+		if frameCode(d) != goAwayCode {
+			frames = append(frames, d)
+			continue
+		}
+
+		if f, err := parseGoAway(d); err != nil || f.Reason != rstProtocolError {
+			t.Fatalf("expected a PROTOCOL_ERROR GO_AWAY, got %+v %v", f, err)
+		}
+		break
+	}
+
+	if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the connection to close, got %v", err)
+	}
+	return frames
+}
+
+func TestPingFlood(t *testing.T) {
+	peer := floodPeer(t, RateLimits{Interval: time.Minute, Pings: 5}, func(w io.Writer) {
+		for id := uint32(1); id < 100; id += 2 {
+			if (&pingFrame{Version: 3, Id: id}).WriteFrame(w, nil) != nil {
+				return
+			}
+		}
+	})
+
+	// Pings within the limit are answered
+	frames := expectGoAway(t, peer)
+	if len(frames) != 5 {
+		t.Fatalf("expected 5 PING replies, got %d frames", len(frames))
+	}
+	for _, d := range frames {
+		if _, err := parsePing(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSettingsFlood(t *testing.T) {
+	peer := floodPeer(t, RateLimits{Interval: time.Minute, Settings: 5}, func(w io.Writer) {
+		for i := 0; i < 100; i++ {
+			f := &settingsFrame{Version: 3, HaveWindow: true, Window: defaultWindow}
+			if f.WriteFrame(w, nil) != nil {
+				return
+			}
+		}
+	})
+
+	expectGoAway(t, peer)
+}
+
+func TestResetFlood(t *testing.T) {
+	// Resets for streams that were never opened still count
+	peer := floodPeer(t, RateLimits{Interval: time.Minute, Resets: 5}, func(w io.Writer) {
+		for id := 1; id < 200; id += 2 {
+			f := &rstStreamFrame{Version: 3, StreamId: id, Reason: rstCancel}
+			if f.WriteFrame(w, nil) != nil {
+				return
+			}
+		}
+	})
+
+	expectGoAway(t, peer)
+}
+
+func TestResetStreamFlood(t *testing.T) {
+	peer := floodPeer(t, RateLimits{Interval: time.Minute, ResetStreams: 5}, func(w io.Writer) {
+		zip := new(compressor)
+		for id := 1; id < 20; id += 2 {
+			syn := &synStreamFrame{Version: 3, StreamId: id, Raw: true}
+			if syn.WriteFrame(w, zip) != nil {
+				return
+			}
+			rst := &rstStreamFrame{Version: 3, StreamId: id, Reason: rstCancel}
+			if rst.WriteFrame(w, nil) != nil {
+				return
+			}
+		}
+	})
+
+	expectGoAway(t, peer)
+}
+
+func TestAbortWhileNotReading(t *testing.T) {
+	peer, s := openRawPeer(t, func(c *Connection) {
+		c.SetRateLimits(RateLimits{})
+	})
+	c := s.connection
+
+	// Fill up the control queue with replies that the peer never reads
+	for id := uint32(1); id < 2000; id += 2 {
+		(&pingFrame{Version: 3, Id: id}).WriteFrame(peer, nil)
+	}
+
+	// A session error then tears down the stream and the connection
+	(&pingFrame{Version: 2, Id: 2001}).WriteFrame(peer, nil)
+
+	select {
+	case <-c.Closed():
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection wasn't closed")
+	}
+}
+
+func TestFramesBeforeClose(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		peer, sock := net.Pipe()
+		started := make(chan bool, 1)
+		c := NewConnection(sock, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started <- true
+		}), 3, true)
+		go c.Run()
+
+		go io.Copy(ioutil.Discard, peer)
+
+		// Frames that were queued before the socket closed are still
+		// handled.
+		buf := new(bytes.Buffer)
+		for id := uint32(1); id < 40; id += 2 {
+			(&pingFrame{Version: 3, Id: id}).WriteFrame(buf, nil)
+		}
+		syn := &synStreamFrame{Version: 3, StreamId: 1, Finished: true, URL: testurl, Method: "GET", Proto: "HTTP/1.1"}
+		syn.WriteFrame(buf, new(compressor))
+		peer.Write(buf.Bytes())
+		peer.Close()
+
+		<-c.Closed()
+		select {
+		case <-started:
+		case <-time.After(time.Second):
+			t.Fatal("the request wasn't handled")
+		}
+	}
+}
+
+func TestResponseAfterClose(t *testing.T) {
+	peer, sock := net.Pipe()
+	c := NewConnection(sock, nil, 3, false)
+	go c.Run()
+
+	// The server sends the whole response and then closes the socket, as
+	// it does once it has been told to go away.
+	go func() {
+		defer peer.Close()
+
+		h := make([]byte, 8)
+		if _, err := io.ReadFull(peer, h); err != nil {
+			return
+		}
+		if _, err := io.CopyN(ioutil.Discard, peer, int64(fromBig32(h[4:])&0xFFFFFF)); err != nil {
+			return
+		}
+
+		reply := &synReplyFrame{Version: 3, StreamId: 1, Status: "200 OK", Proto: "HTTP/1.1"}
+		reply.WriteFrame(peer, new(compressor))
+		(&dataFrame{StreamId: 1, Finished: true, Data: []byte("hello")}).WriteFrame(peer, nil)
+	}()
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	resp, err := c.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The response can still be read after the connection has gone
+	<-c.Closed()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("got %q %v", data, err)
+	}
+	resp.Body.Close()
+}
+
+func TestGoAwayWhileNotReading(t *testing.T) {
+	peer, s := openRawPeer(t, func(c *Connection) {
+		c.SetRateLimits(RateLimits{})
+	})
+	c := s.connection
+
+	// Fill up the control queue with replies that the peer never reads
+	for id := uint32(1); id < 2000; id += 2 {
+		(&pingFrame{Version: 3, Id: id}).WriteFrame(peer, nil)
+	}
+
+	go c.GoAway()
+
+	select {
+	case <-c.Closed():
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection wasn't closed")
+	}
+}
+
+func TestFloodWhileNotReading(t *testing.T) {
+	// Limits around the size of the control queue leave it anywhere from
+	// full to having room for the GO_AWAY but not what follows.
+	for limit := 90; limit < 110; limit++ {
+		peer, s := openRawPeer(t, func(c *Connection) {
+			c.SetRateLimits(RateLimits{Interval: time.Minute, Pings: limit})
+		})
+		c := s.connection
+
+		go func() {
+			for id := uint32(1); id < 1000; id += 2 {
+				if (&pingFrame{Version: 3, Id: id}).WriteFrame(peer, nil) != nil {
+					return
+				}
+			}
+		}()
+
+		select {
+		case <-c.Closed():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("connection with a limit of %d wasn't closed", limit)
+		}
+	}
+}
+
+func TestDataAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool is unreliable with the race detector")
+	}
+
+	client, server := newConnectionPair(t, 3)
+	defer client.Close()
+
+	s1, err := client.OpenStream(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, maxDataPacketSize)
+	buf := make([]byte, maxDataPacketSize)
+	send := func() {
+		s1.Write(data)
+		if _, err := io.ReadFull(s2, buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Warm up the pools
+	for i := 0; i < 100; i++ {
+		send()
+	}
+
+	// Only the occasional WINDOW_UPDATE allocates, on both the sending
+	// and receiving sides.
+	if n := testing.AllocsPerRun(1000, send); n >= 1 {
+		t.Fatalf("DATA frames allocated %v times each", n)
+	}
+}
+
+// countingConn counts the bytes written to it.
+type countingConn struct {
+	net.Conn
+	written int64
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	atomic.AddInt64(&c.written, int64(len(b)))
+	return c.Conn.Write(b)
+}
+
+// BenchmarkWindowUpdates measures the control traffic sent back by the
+// receiver of a bulk download read in small chunks. With the default 64KB
+// window the tiny fraction is a 65 byte threshold, so every 1KB read sends
+// an update as the connection did before updates were coalesced.
+func BenchmarkWindowUpdates(b *testing.B) {
+	for _, fraction := range []float64{0.001, DefaultWindowUpdateFraction} {
+		b.Run(fmt.Sprintf("fraction=%g", fraction), func(b *testing.B) {
+			a, sock := net.Pipe()
+			rx := &countingConn{Conn: a}
+			client := NewConnection(rx, nil, 3, false)
+			client.SetWindowUpdate(fraction, -1)
+			server := NewConnection(sock, nil, 3, true)
+			server.SetAcceptStreams(true)
+			go client.Run()
+			go server.Run()
+			defer client.Close()
+
+			s1, _ := client.OpenStream(nil, 0)
+			s2, _ := server.AcceptStream()
+
+			const size = 1 << 20
+			go func() {
+				chunk := make([]byte, 32*1024)
+				for i := 0; i < b.N*size/len(chunk); i++ {
+					s2.Write(chunk)
+				}
+				s2.CloseWrite()
+			}()
+
+			b.SetBytes(size)
+			b.ResetTimer()
+			buf := make([]byte, 1024)
+			for {
+				if _, err := s1.Read(buf); err != nil {
+					break
+				}
+			}
+			b.StopTimer()
+
+			b.ReportMetric(float64(atomic.LoadInt64(&rx.written))/float64(b.N), "rx-ctrl-B/op")
+		})
+	}
+}
+
+// latencyConn delivers writes after a delay to simulate a high latency
+// link, without holding up the writer.
+type latencyConn struct {
+	net.Conn
+	delay  time.Duration
+	queued chan latencyWrite
+}
+
+type latencyWrite struct {
+	due  time.Time
+	data []byte
+}
+
+func newLatencyConn(c net.Conn, delay time.Duration) *latencyConn {
+	lc := &latencyConn{c, delay, make(chan latencyWrite, 1000)}
+	go func() {
+		for w := range lc.queued {
+			time.Sleep(time.Until(w.due))
+			if _, err := c.Write(w.data); err != nil {
+				return
+			}
+		}
+	}()
+	return lc
+}
+
+func (c *latencyConn) Write(b []byte) (int, error) {
+	c.queued <- latencyWrite{time.Now().Add(c.delay), append([]byte(nil), b...)}
+	return len(b), nil
+}
+
+func TestAutoTuneWindow(t *testing.T) {
+	a, b := net.Pipe()
+	client := NewConnection(newLatencyConn(a, 200*time.Millisecond), nil, 3, false)
+	server := NewConnection(b, nil, 3, true)
+	client.SetAutoTuneBudget(200 * 1024)
+	server.SetAcceptStreams(true)
+	go client.Run()
+	go server.Run()
+	defer client.Close()
+
+	s1, _ := client.OpenStream(nil, 0)
+	s2, _ := server.AcceptStream()
+
+	// Wait for the round trip time to be measured
+	for client.roundTripTime() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	data := bytes.Repeat([]byte("0123456789"), 30*1024)
+	go func() {
+		s2.Write(data)
+		s2.CloseWrite()
+	}()
+
+	if got, err := ioutil.ReadAll(s1); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("got %d bytes %v", len(got), err)
+	}
+
+	s1.rxLock.Lock()
+	size := s1.rxWindowSize
+	s1.rxLock.Unlock()
+
+	if size <= defaultWindow || size > defaultWindow+200*1024 {
+		t.Fatalf("expected the window to grow within the budget, got %d", size)
+	}
+
+	s1.Close()
+	client.NumStreams() // wait for the close to be handled
+	if used := atomic.LoadInt64(&client.rxBudgetUsed); used != 0 {
+		t.Fatalf("expected the budget to be released, %d still used", used)
+	}
+}
+
+// newTCPConnectionPair is like newConnectionPair but over a loopback TCP
+// socket so that the cost of writes shows up in benchmarks.
+func newTCPConnectionPair(tb testing.TB) (client, server *Connection) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer l.Close()
+
+	a, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	b, err := l.Accept()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	client = NewConnection(a, nil, 3, false)
+	server = NewConnection(b, nil, 3, true)
+	server.SetAcceptStreams(true)
+	go client.Run()
+	go server.Run()
+	return client, server
+}
+
+// BenchmarkTx measures upload throughput from one or many concurrent
+// streams.
+func BenchmarkTx(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, streams := range []int{1, 16} {
+		b.Run(fmt.Sprintf("streams=%d", streams), func(b *testing.B) {
+			client, server := newTCPConnectionPair(b)
+			defer client.Close()
+
+			const size = 1 << 20
+			b.SetBytes(size)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				var wg sync.WaitGroup
+				for j := 0; j < streams; j++ {
+					s, err := client.OpenStream(nil, 0)
+					if err != nil {
+						b.Fatal(err)
+					}
+
+					wg.Add(2)
+					go func() {
+						defer wg.Done()
+						chunk := make([]byte, 16*1024)
+						for n := 0; n < size/streams; n += len(chunk) {
+							s.Write(chunk)
+						}
+						s.CloseWrite()
+						io.Copy(ioutil.Discard, s)
+						s.Close()
+					}()
+
+					r, err := server.AcceptStream()
+					if err != nil {
+						b.Fatal(err)
+					}
+					go func() {
+						defer wg.Done()
+						io.Copy(ioutil.Discard, r)
+						r.Close()
+					}()
+				}
+				wg.Wait()
+			}
+		})
+	}
+}
+
+// BenchmarkDownload measures the throughput of one large response.
+func BenchmarkDownload(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	client, server := newTCPConnectionPair(b)
+	defer client.Close()
+
+	const size = 4 << 20
+	b.SetBytes(size)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		s, err := client.OpenStream(nil, 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		s.CloseWrite()
+
+		r, err := server.AcceptStream()
+		if err != nil {
+			b.Fatal(err)
+		}
+		go func() {
+			chunk := make([]byte, 32*1024)
+			for n := 0; n < size; n += len(chunk) {
+				r.Write(chunk)
+			}
+			r.Close()
+		}()
+
+		if n, err := io.Copy(ioutil.Discard, s); n != size || err != nil {
+			b.Fatalf("read %d: %v", n, err)
+		}
+		s.Close()
+	}
+}
+
+// BenchmarkSmallStreams measures the rate of many concurrent short
+// request/response exchanges on one connection.
+func BenchmarkSmallStreams(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	client, server := newTCPConnectionPair(b)
+	defer client.Close()
+
+	go func() {
+		for {
+			r, err := server.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				req, _ := ioutil.ReadAll(r)
+				r.Write(req)
+				r.Close()
+			}()
+		}
+	}()
+
+	b.SetParallelism(16)
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		req := make([]byte, 1024)
+		for pb.Next() {
+			s, err := client.OpenStream(nil, 0)
+			if err != nil {
+				b.Fatal(err)
+			}
+			s.Write(req)
+			s.CloseWrite()
+			if n, err := io.Copy(ioutil.Discard, s); n != int64(len(req)) || err != nil {
+				b.Fatalf("read %d: %v", n, err)
+			}
+			s.Close()
+		}
+	})
+}
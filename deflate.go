@@ -0,0 +1,316 @@
+package spdy
+
+import (
+	"compress/zlib"
+	"hash/adler32"
+)
+
+const (
+	windowSize = 1 << 15
+	windowMask = windowSize - 1
+	hashBits   = 14
+	minMatch   = 3
+	maxMatch   = 258
+	maxStored  = 0xFFFF
+)
+
+// headerDeflater is a deflate compressor for the header compression context
+// that a connection shares between all of its frames. Unlike compress/zlib
+// it can send data in stored blocks which are never used as the source of a
+// back reference. Secret header values are sent that way so that an
+// attacker who controls other headers can't learn them from the size of the
+// compressed frames (CRIME).
+//
+// Other data is compressed with LZ77 and the fixed Huffman codes. For small
+// header blocks these are close to what dynamic codes give as the code
+// tables aren't sent.
+type headerDeflater struct {
+	out   []byte
+	bits  uint64
+	nbits uint
+
+	chain   int  // how many earlier matches to try, 0 stores everything
+	inBlock bool // a fixed Huffman block is open
+
+	// hist holds at least the last windowSize bytes of uncompressed data.
+	// Bytes marked in secret are never matched.
+	hist   []byte
+	secret []bool
+	head   [1 << hashBits]int32 // latest position in hist with a hash, plus one
+	prev   [windowSize]int32    // previous position with the same hash, plus one
+}
+
+// chainLength maps zlib compression levels to how hard we look for matches.
+var chainLength = [...]int{0, 4, 8, 16, 32, 64, 128, 256, 1024, 4096}
+
+// init starts the zlib stream with the preset dictionary.
+func (z *headerDeflater) init(level int, dict []byte) {
+	if level == zlib.DefaultCompression {
+		level = 6
+	}
+	z.chain = chainLength[level]
+
+	flevel := 0
+	switch {
+	case level >= 7:
+		flevel = 3
+	case level == 6:
+		flevel = 2
+	case level >= 2:
+		flevel = 1
+	}
+
+	h := uint(0x78)<<8 | uint(flevel)<<6 | 0x20 // FDICT
+	if h%31 != 0 {
+		h += 31 - h%31
+	}
+
+	sum := adler32.Checksum(dict)
+	z.out = append(z.out, byte(h>>8), byte(h),
+		byte(sum>>24), byte(sum>>16), byte(sum>>8), byte(sum))
+
+	z.hist = z.hist[:0]
+	z.secret = z.secret[:0]
+	z.append(dict, false)
+	for i := range z.hist {
+		z.insert(i)
+	}
+}
+
+// Write compresses data.
+func (z *headerDeflater) Write(data []byte) {
+	for len(data) > 0 {
+		n := len(data)
+		if n > windowSize {
+			n = windowSize
+		}
+
+		if z.chain == 0 {
+			z.store(data[:n], false)
+		} else {
+			z.compress(data[:n])
+		}
+		data = data[n:]
+	}
+}
+
+// WriteSecret sends data in stored blocks that are never matched.
+func (z *headerDeflater) WriteSecret(data []byte) {
+	for len(data) > 0 {
+		n := len(data)
+		if n > windowSize {
+			n = windowSize
+		}
+
+		z.store(data[:n], true)
+		data = data[n:]
+	}
+}
+
+// Flush ends the current block and byte aligns the output with an empty
+// stored block, as with zlib's sync flush.
+func (z *headerDeflater) Flush() {
+	z.endBlock()
+	z.writeBits(0, 3)
+	z.alignBits()
+	z.out = append(z.out, 0, 0, 0xFF, 0xFF)
+}
+
+// append adds data to the history, sliding the window along if needed.
+func (z *headerDeflater) append(data []byte, secret bool) {
+	if len(z.hist)+len(data) > 3*windowSize {
+		// Drop a multiple of the window size so that positions keep
+		// their place in prev.
+		d := (len(z.hist) - windowSize) &^ windowMask
+		copy(z.hist, z.hist[d:])
+		copy(z.secret, z.secret[d:])
+		z.hist = z.hist[:len(z.hist)-d]
+		z.secret = z.secret[:len(z.secret)-d]
+
+		for i, p := range z.head {
+			z.head[i] = slide(p, d)
+		}
+		for i, p := range z.prev {
+			z.prev[i] = slide(p, d)
+		}
+	}
+
+	z.hist = append(z.hist, data...)
+	for range data {
+		z.secret = append(z.secret, secret)
+	}
+}
+
+func slide(p int32, d int) int32 {
+	if int(p) <= d {
+		return 0
+	}
+	return p - int32(d)
+}
+
+func (z *headerDeflater) hash(i int) int {
+	h := uint32(z.hist[i])<<16 | uint32(z.hist[i+1])<<8 | uint32(z.hist[i+2])
+	return int((h * 0x9E3779B1) >> (32 - hashBits))
+}
+
+// insert adds the match starting at position i in the history.
+func (z *headerDeflater) insert(i int) {
+	if i+minMatch > len(z.hist) {
+		return
+	}
+	h := z.hash(i)
+	z.prev[i&windowMask] = z.head[h]
+	z.head[h] = int32(i + 1)
+}
+
+// compress adds data to the history and encodes it with greedy matching.
+func (z *headerDeflater) compress(data []byte) {
+	z.append(data, false)
+	i := len(z.hist) - len(data)
+
+	for i < len(z.hist) {
+		length, dist := z.findMatch(i)
+
+		if length < minMatch {
+			z.writeSymbol(int(z.hist[i]))
+			z.insert(i)
+			i++
+			continue
+		}
+
+		z.writeMatch(length, dist)
+		for end := i + length; i < end; i++ {
+			z.insert(i)
+		}
+	}
+}
+
+// findMatch returns the longest earlier match for the data at position i.
+func (z *headerDeflater) findMatch(i int) (length, dist int) {
+	if i+minMatch > len(z.hist) {
+		return 0, 0
+	}
+
+	limit := len(z.hist) - i
+	if limit > maxMatch {
+		limit = maxMatch
+	}
+
+	cand := int(z.head[z.hash(i)]) - 1
+	for n := z.chain; n > 0 && cand >= 0 && cand < i && i-cand <= windowSize; n-- {
+		l := 0
+		for l < limit && z.hist[cand+l] == z.hist[i+l] && !z.secret[cand+l] {
+			l++
+		}
+
+		if l > length {
+			length, dist = l, i-cand
+			if l == limit {
+				break
+			}
+		}
+
+		cand = int(z.prev[cand&windowMask]) - 1
+	}
+
+	return length, dist
+}
+
+// store sends data in stored blocks.
+func (z *headerDeflater) store(data []byte, secret bool) {
+	z.append(data, secret)
+	z.endBlock()
+
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxStored {
+			n = maxStored
+		}
+
+		z.writeBits(0, 3) // not final, stored
+		z.alignBits()
+		z.out = append(z.out, byte(n), byte(n>>8), ^byte(n), ^byte(n>>8))
+		z.out = append(z.out, data[:n]...)
+		data = data[n:]
+	}
+}
+
+func (z *headerDeflater) endBlock() {
+	if z.inBlock {
+		z.writeSymbol(256)
+		z.inBlock = false
+	}
+}
+
+func (z *headerDeflater) writeBits(v uint64, n uint) {
+	z.bits |= v << z.nbits
+	z.nbits += n
+	for z.nbits >= 8 {
+		z.out = append(z.out, byte(z.bits))
+		z.bits >>= 8
+		z.nbits -= 8
+	}
+}
+
+func (z *headerDeflater) alignBits() {
+	if z.nbits > 0 {
+		z.writeBits(0, 8-z.nbits)
+	}
+}
+
+// writeSymbol writes a literal/length symbol with the fixed Huffman codes,
+// starting a block if needed.
+func (z *headerDeflater) writeSymbol(sym int) {
+	if !z.inBlock {
+		z.writeBits(1<<1, 3) // not final, fixed Huffman
+		z.inBlock = true
+	}
+
+	var code, n uint
+	switch {
+	case sym < 144:
+		code, n = 0x30+uint(sym), 8
+	case sym < 256:
+		code, n = 0x190+uint(sym-144), 9
+	case sym < 280:
+		code, n = uint(sym-256), 7
+	default:
+		code, n = 0xC0+uint(sym-280), 8
+	}
+
+	z.writeBits(uint64(reverseBits(code, n)), n)
+}
+
+var (
+	lengthBase  = [...]int{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+	lengthExtra = [...]uint{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+	distBase    = [...]int{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577}
+	distExtra   = [...]uint{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+)
+
+func (z *headerDeflater) writeMatch(length, dist int) {
+	i := len(lengthBase) - 1
+	for lengthBase[i] > length {
+		i--
+	}
+	z.writeSymbol(257 + i)
+	z.writeBits(uint64(length-lengthBase[i]), lengthExtra[i])
+
+	j := len(distBase) - 1
+	for distBase[j] > dist {
+		j--
+	}
+	z.writeBits(uint64(reverseBits(uint(j), 5)), 5)
+	z.writeBits(uint64(dist-distBase[j]), distExtra[j])
+}
+
+// reverseBits reverses the bottom n bits of v, as Huffman codes are packed
+// starting with their most significant bit.
+func reverseBits(v, n uint) uint {
+	r := uint(0)
+	for i := uint(0); i < n; i++ {
+		r = r<<1 | v&1
+		v >>= 1
+	}
+	return r
+}
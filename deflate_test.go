@@ -0,0 +1,133 @@
+package spdy
+
+import (
+	"bytes"
+	"compress/zlib"
+	"math/rand"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHeaderCompression(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	words := []string{"text/html", "gzip", "en-US", "max-age=0", "/index.html", "example.com"}
+
+	for _, level := range []int{zlib.NoCompression, 1, zlib.DefaultCompression, zlib.BestCompression} {
+		zip := compressor{level: level, sensitive: headerSet(DefaultSensitiveHeaders)}
+		unzip := decompressor{}
+
+		for i := 0; i < 100; i++ {
+			header := http.Header{}
+			for j := rnd.Intn(8); j >= 0; j-- {
+				key := []string{"Accept", "Cookie", "Host", "X-Value"}[rnd.Intn(4)]
+				val := words[rnd.Intn(len(words))]
+				if rnd.Intn(4) == 0 {
+					val = strings.Repeat(val, rnd.Intn(2000))
+				}
+				header.Add(key, val)
+			}
+
+			// Large enough to slide the window along
+			if i%25 == 0 {
+				header.Set("X-Large", strings.Repeat("abcdefgh", 20000))
+				header.Set("Cookie", strings.Repeat("secret", 20000))
+			}
+
+			if err := zip.Begin(3, 12, header, 0); err != nil {
+				t.Fatal(err)
+			}
+			got, err := unzip.Decompress(1, 3, zip.Finish()[12:])
+			if err != nil {
+				t.Fatalf("level %d frame %d: %v", level, i, err)
+			}
+			if !reflect.DeepEqual(got, header) {
+				t.Fatalf("level %d frame %d: headers differ", level, i)
+			}
+		}
+	}
+}
+
+// compressedSizes returns the size of a frame carrying both the secret and
+// a header chosen by the attacker, and the size of a frame carrying only the
+// attacker's header sent after one with only the secret.
+func compressedSizes(sensitive []string, secret, guess string) (int, int) {
+	zip := compressor{level: zlib.BestCompression, sensitive: headerSet(sensitive)}
+	zip.Begin(3, 12, http.Header{"Cookie": {secret}, "X-Attack": {guess}}, 0)
+	same := len(zip.Finish())
+
+	zip = compressor{level: zlib.BestCompression, sensitive: headerSet(sensitive)}
+	zip.Begin(3, 12, http.Header{"Cookie": {secret}}, 0)
+	zip.Finish()
+	zip.Begin(3, 12, http.Header{"X-Attack": {guess}}, 0)
+	later := len(zip.Finish())
+
+	return same, later
+}
+
+func TestSensitiveHeaders(t *testing.T) {
+	const secret = "session=4a7f9c2e81b3"
+	guesses := []string{
+		secret,
+		"session=4a7f9c2e8000",
+		"session=zzzzzzzzzzzz",
+		"xxxxxxxxxxxxxxxxxxxx",
+	}
+
+	// Without protection a correct guess compresses better
+	right1, right2 := compressedSizes(nil, secret, guesses[0])
+	wrong1, wrong2 := compressedSizes(nil, secret, guesses[3])
+	if right1 >= wrong1 || right2 >= wrong2 {
+		t.Fatalf("expected the secret to leak, got %d %d vs %d %d", right1, right2, wrong1, wrong2)
+	}
+
+	// Otherwise the secret makes no difference to the sizes, both in the
+	// frame that carries it and in later ones.
+	for _, guess := range guesses {
+		same, later := compressedSizes([]string{"Cookie"}, secret, guess)
+		other1, other2 := compressedSizes([]string{"Cookie"}, strings.Repeat("-", len(secret)), guess)
+		if same != other1 || later != other2 {
+			t.Errorf("guess %q: got sizes %d %d, expected %d %d", guess, same, later, other1, other2)
+		}
+	}
+
+	// And it is sent as it is
+	zip := compressor{level: zlib.BestCompression, sensitive: headerSet([]string{"cookie"})}
+	zip.Begin(3, 12, http.Header{"Cookie": {secret}}, 0)
+	if !bytes.Contains(zip.Finish(), []byte(secret)) {
+		t.Error("secret was compressed")
+	}
+}
+
+func TestNoHeaderCompression(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	// Level 0 can only be reached with DisableHeaderCompression
+	conns := []*Connection{
+		(&Transport{DisableHeaderCompression: true}).newConnection(a, 3),
+		(&Server{DisableHeaderCompression: true}).newConnection(b, 3),
+	}
+	for _, c := range conns {
+		if c.txHeaderLevel != zlib.NoCompression {
+			t.Fatalf("header compression level %d", c.txHeaderLevel)
+		}
+	}
+
+	value := strings.Repeat("abcd", 100)
+	zip := compressor{level: conns[0].txHeaderLevel}
+	zip.Begin(3, 12, http.Header{"X-Value": {value}}, 0)
+	d := zip.Finish()
+
+	// After the zlib header and dictionary id comes a stored block, with
+	// the repeated value sent as is.
+	if d[12+6]&7 != 0 {
+		t.Fatalf("expected a stored block, got header bits %b", d[12+6]&7)
+	}
+	if !bytes.Contains(d, []byte(value)) {
+		t.Fatal("the header wasn't stored uncompressed")
+	}
+}
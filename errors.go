@@ -15,10 +15,16 @@ type streamError interface {
 }
 
 var (
-	ErrGoAway             = errors.New("spdy: go away")
-	ErrSessionFlowControl = errors.New("spdy: flow control error")
-	ErrSessionProtocol    = errors.New("sydy: protocol error")
-	ErrWriteAfterClose    = errors.New("spdy: write to closed stream")
+	ErrGoAway               = errors.New("spdy: go away")
+	ErrSessionFlowControl   = errors.New("spdy: flow control error")
+	ErrSessionProtocol      = errors.New("sydy: protocol error")
+	ErrWriteAfterClose      = errors.New("spdy: write to closed stream")
+	ErrConnectionClosed     = errors.New("spdy: connection closed")
+	ErrSessionFrameTooLarge = errors.New("spdy: control frame too large")
+
+	// errConnectionDone tells the rx thread that the connection thread
+	// has already exited.
+	errConnectionDone = errors.New("spdy: connection done")
 )
 
 type ErrStreamProtocol int
@@ -28,9 +34,16 @@ type ErrCancel int
 type ErrStreamFlowControl int
 type ErrStreamInUse int
 type ErrStreamAlreadyClosed int
+type ErrFrameTooLarge int
+type ErrStreamTimeout int
+type ErrRateLimit string
 type ErrSessionVersion int
 type ErrParse []byte
 type ErrUnsupportedProxy string
+type ErrProxyAuthRequired struct {
+	Proxy     string   // host:port of the proxy
+	Challenge []string // the proxy's Proxy-Authenticate headers
+}
 type ErrStreamVersion struct {
 	streamId int
 	version  int
@@ -53,6 +66,10 @@ func (s ErrUnsupportedProxy) Error() string {
 	return fmt.Sprintf("spdy: unsupported proxy %s", string(s))
 }
 
+func (s *ErrProxyAuthRequired) Error() string {
+	return fmt.Sprintf("spdy: proxy %s requires authentication %v", s.Proxy, s.Challenge)
+}
+
 func (s ErrSessionVersion) resetCode() int { return rstUnsupportedVersion }
 func (s ErrSessionVersion) Error() string {
 	return fmt.Sprintf("spdy: unsupported version %d", int(s))
@@ -111,3 +128,20 @@ func (s ErrStreamAlreadyClosed) resetCode() int { return rstStreamAlreadyClosed
 func (s ErrStreamAlreadyClosed) Error() string {
 	return fmt.Sprintf("spdy: stream %d has already been closed", int(s))
 }
+
+func (s ErrFrameTooLarge) StreamId() int  { return int(s) }
+func (s ErrFrameTooLarge) resetCode() int { return rstFrameTooLarge }
+func (s ErrFrameTooLarge) Error() string {
+	return fmt.Sprintf("spdy: frame too large on stream %d", int(s))
+}
+
+func (s ErrStreamTimeout) StreamId() int  { return int(s) }
+func (s ErrStreamTimeout) resetCode() int { return rstCancel }
+func (s ErrStreamTimeout) Error() string {
+	return fmt.Sprintf("spdy: stream %d timed out", int(s))
+}
+
+func (s ErrRateLimit) resetCode() int { return rstProtocolError }
+func (s ErrRateLimit) Error() string {
+	return fmt.Sprintf("spdy: remote sent too many %s frames", string(s))
+}
@@ -6,6 +6,13 @@ import (
 	"net"
 )
 
+// LogDataFrames enables logging each DATA frame, and the WINDOW_UPDATEs
+// that go along with them, that are sent or received. Other control frames
+// are always logged. It's off by default as these are the bulk of the
+// traffic and formatting them would be most of their cost. Set it before
+// starting any connections.
+var LogDataFrames = false
+
 type connLogger struct {
 	net.Conn
 	prefix string
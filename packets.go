@@ -8,6 +8,7 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"sort"
 	"strings"
 )
 
@@ -45,6 +46,7 @@ const (
 	rstFlowControlError    = 6
 	rstStreamInUse         = 7
 	rstStreamAlreadyClosed = 8
+	rstFrameTooLarge       = 11
 )
 
 func toBig16(d []byte, val uint16) {
@@ -89,8 +91,10 @@ type input struct {
 }
 
 type decompressor struct {
-	in  *bytes.Buffer
-	out io.ReadCloser
+	in      *bytes.Buffer
+	out     io.ReadCloser
+	lenbuf  [4]byte
+	scratch []byte // key or value being read, reused between headers
 }
 
 func (s *decompressor) Decompress(streamId int, version int, data []byte) (headers http.Header, err error) {
@@ -116,46 +120,29 @@ func (s *decompressor) Decompress(streamId int, version int, data []byte) (heade
 		}
 	}
 
-	var numkeys int
-
-	switch version {
-	case 2:
-		h := [2]byte{}
-		if _, err := s.out.Read(h[:]); err != nil {
-			return nil, err
-		}
-		numkeys = int(fromBig16(h[:]))
-	case 3:
-		h := [4]byte{}
-		if _, err := s.out.Read(h[:]); err != nil {
-			return nil, err
-		}
-		numkeys = int(fromBig32(h[:]))
-	default:
+	if version != 2 && version != 3 {
 		return nil, ErrStreamVersion{streamId, version}
 	}
 
-	headers = make(http.Header)
+	numkeys, err := s.readLength(version)
+	if err != nil {
+		return nil, err
+	}
+
+	// The count comes from the remote so only trust it so far
+	hint := numkeys
+	if hint > 32 {
+		hint = 32
+	}
+
+	headers = make(http.Header, hint)
 	for i := 0; i < numkeys; i++ {
 		var klen, vlen int
 
 		// Pull out the key
 
-		switch version {
-		case 2:
-			h := [2]byte{}
-			if _, err := s.out.Read(h[:]); err != nil {
-				return nil, err
-			}
-			klen = int(fromBig16(h[:]))
-		case 3:
-			h := [4]byte{}
-			if _, err := s.out.Read(h[:]); err != nil {
-				return nil, err
-			}
-			klen = int(fromBig32(h[:]))
-		default:
-			return nil, ErrStreamVersion{streamId, version}
+		if klen, err = s.readLength(version); err != nil {
+			return nil, err
 		}
 
 		if klen < 0 {
@@ -163,28 +150,16 @@ func (s *decompressor) Decompress(streamId int, version int, data []byte) (heade
 			return nil, ErrParse(data)
 		}
 
-		key := make([]byte, klen)
-		if _, err := s.out.Read(key); err != nil {
+		if err := s.readScratch(klen); err != nil {
 			return nil, err
 		}
 
+		key := canonicalHeaderKey(s.scratch)
+
 		// Pull out the value
 
-		switch version {
-		case 2:
-			h := [2]byte{}
-			if _, err := s.out.Read(h[:]); err != nil {
-				return nil, err
-			}
-			vlen = int(fromBig16(h[:]))
-		case 3:
-			h := [4]byte{}
-			if _, err := s.out.Read(h[:]); err != nil {
-				return nil, err
-			}
-			vlen = int(fromBig32(h[:]))
-		default:
-			return nil, ErrStreamVersion{streamId, version}
+		if vlen, err = s.readLength(version); err != nil {
+			return nil, err
 		}
 
 		if vlen < 0 {
@@ -192,126 +167,217 @@ func (s *decompressor) Decompress(streamId int, version int, data []byte) (heade
 			return nil, ErrParse(data)
 		}
 
-		val := make([]byte, vlen)
-		if _, err := s.out.Read(val); err != nil {
+		if err := s.readScratch(vlen); err != nil {
 			return nil, err
 		}
 
-		// Split the value on nul boundaries
-		for _, val := range bytes.Split(val, []byte{'\x00'}) {
-			headers.Add(string(key), string(val))
+		// Split the value on nul boundaries, the values all share the
+		// one string
+		val := string(s.scratch)
+		vals := headers[key]
+		if vals == nil {
+			vals = make([]string, 0, strings.Count(val, "\x00")+1)
 		}
+
+		for {
+			i := strings.IndexByte(val, 0)
+			if i < 0 {
+				break
+			}
+			vals = append(vals, val[:i])
+			val = val[i+1:]
+		}
+
+		headers[key] = append(vals, val)
 	}
 
 	return headers, nil
 }
 
+// readLength reads a key or value length.
+func (s *decompressor) readLength(version int) (int, error) {
+	h := s.lenbuf[:4]
+	if version == 2 {
+		h = s.lenbuf[:2]
+	}
+
+	if _, err := io.ReadFull(s.out, h); err != nil {
+		return 0, err
+	}
+
+	if version == 2 {
+		return int(fromBig16(h)), nil
+	}
+	return int(fromBig32(h)), nil
+}
+
+// readScratch reads the next n bytes into the scratch buffer.
+func (s *decompressor) readScratch(n int) error {
+	if cap(s.scratch) < n {
+		s.scratch = make([]byte, n)
+	}
+	s.scratch = s.scratch[:n]
+	_, err := io.ReadFull(s.out, s.scratch)
+	return err
+}
+
+// canonicalHeaderKey returns http.CanonicalHeaderKey(string(key)) with only
+// the one allocation. Keys with characters that aren't valid in a header
+// name are left as they are, which includes the SPDY/3 pseudo headers.
+func canonicalHeaderKey(key []byte) string {
+	for _, c := range key {
+		if !isHeaderKeyByte(c) {
+			return string(key)
+		}
+	}
+
+	upper := true
+	for i, c := range key {
+		if upper && 'a' <= c && c <= 'z' {
+			key[i] = c - ('a' - 'A')
+		} else if !upper && 'A' <= c && c <= 'Z' {
+			key[i] = c + ('a' - 'A')
+		}
+		upper = c == '-'
+	}
+
+	return string(key)
+}
+
+func isHeaderKeyByte(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+// compressor compresses header blocks with the compression context shared
+// by all of the frames sent on a connection. The zero value sends headers
+// uncompressed, as with zlib.NoCompression.
 type compressor struct {
-	buf *bytes.Buffer
-	w   *zlib.Writer
+	level     int             // zlib compression level
+	sensitive map[string]bool // headers sent as secrets, see Connection.SetSensitiveHeaders
+
+	z       *headerDeflater
+	version int
+	block   []byte   // uncompressed header block, reused between frames
+	keys    []string // sorted header keys, reused between frames
+	secrets []int    // start and end of each secret value in block
 }
 
-func (s *compressor) Begin(version int, init []byte, headers http.Header, numkeys int) (err error) {
-	if s.buf == nil {
-		s.buf = bytes.NewBuffer(make([]byte, 0, len(init)))
-		s.buf.Write(init)
+// zeroHeader reserves room for the frame header in front of the compressed
+// headers.
+var zeroHeader [18]byte
+
+// Begin starts a compressed header block for a frame with a header of
+// hdrlen bytes, adding the given headers. numkeys is the number of headers
+// that will be added on top of those with CompressV2/V3. The headers are
+// built up uncompressed and then compressed by Finish.
+func (s *compressor) Begin(version int, hdrlen int, headers http.Header, numkeys int) (err error) {
+	if version != 2 && version != 3 {
+		return ErrSessionVersion(version)
+	}
+
+	if s.z == nil {
+		s.z = new(headerDeflater)
+		s.z.out = append(s.z.out, zeroHeader[:hdrlen]...)
 
 		switch version {
 		case 2:
-			s.w, err = zlib.NewWriterDict(s.buf, compressionLevel, []byte(headerDictionaryV2))
+			s.z.init(s.level, []byte(headerDictionaryV2))
 		case 3:
-			s.w, err = zlib.NewWriterDict(s.buf, compressionLevel, []byte(headerDictionaryV3))
-		default:
-			err = ErrSessionVersion(version)
-		}
-
-		if err != nil {
-			return err
+			s.z.init(s.level, []byte(headerDictionaryV3))
 		}
 
 	} else {
-		s.buf.Reset()
-		s.buf.Write(init)
+		s.z.out = append(s.z.out[:0], zeroHeader[:hdrlen]...)
 	}
 
-	// count the number of extra headers
+	s.version = version
+	s.secrets = s.secrets[:0]
+
+	// Sort the extra headers so that the same headers give the same
+	// block, which compresses better and doesn't depend on map order.
+	s.keys = s.keys[:0]
 	for key, _ := range headers {
 		if len(key) > 0 && key[0] != ':' {
-			numkeys++
+			s.keys = append(s.keys, key)
 		}
 	}
+	sort.Strings(s.keys)
 
-	switch version {
-	case 2:
-		var keys [2]byte
-		toBig16(keys[:], uint16(numkeys))
-		s.w.Write(keys[:])
-
-		for key, val := range headers {
-			if len(key) > 0 && key[0] != ':' {
-				var k, v [2]byte
-				vals := strings.Join(val, "\x00")
-
-				toBig16(k[:], uint16(len(key)))
-				s.w.Write(k[:])
-				s.w.Write(bytes.ToLower([]byte(key)))
-
-				toBig16(v[:], uint16(len(vals)))
-				s.w.Write(v[:])
-				s.w.Write([]byte(vals))
+	s.block = s.appendLength(s.block[:0], numkeys+len(s.keys))
+
+	for _, key := range s.keys {
+		vals := headers[key]
+		s.block = s.appendLength(s.block, len(key))
+		for i := 0; i < len(key); i++ {
+			c := key[i]
+			if 'A' <= c && c <= 'Z' {
+				c += 'a' - 'A'
 			}
+			s.block = append(s.block, c)
 		}
-	case 3:
-		var keys [4]byte
-		toBig32(keys[:], uint32(numkeys))
-		s.w.Write(keys[:])
-
-		for key, val := range headers {
-			if len(key) > 0 && key[0] != ':' {
-				var k, v [4]byte
-
-				toBig32(k[:], uint32(len(key)))
-				s.w.Write(k[:])
-				s.w.Write(bytes.ToLower([]byte(key)))
-
-				vals := strings.Join(val, "\x00")
-				toBig32(v[:], uint32(len(vals)))
-				s.w.Write(v[:])
-				s.w.Write([]byte(vals))
+
+		n := len(vals) - 1
+		for _, val := range vals {
+			n += len(val)
+		}
+
+		s.block = s.appendLength(s.block, n)
+		start := len(s.block)
+		for i, val := range vals {
+			if i > 0 {
+				s.block = append(s.block, 0)
 			}
+			s.block = append(s.block, val...)
+		}
+
+		if s.sensitive[http.CanonicalHeaderKey(key)] {
+			s.secrets = append(s.secrets, start, len(s.block))
 		}
-	default:
-		return ErrSessionVersion(version)
 	}
 
 	return nil
 }
 
+func (s *compressor) appendLength(b []byte, n int) []byte {
+	if s.version == 2 {
+		return append(b, byte(n>>8), byte(n))
+	}
+	return append(b, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
 // TODO(james): what to do if len(key) or len(val) > UINT16_MAX or UINT32_MAX
 
 func (s *compressor) CompressV2(key string, val string) {
-	var k, v [2]byte
-	toBig16(k[:], uint16(len(key)))
-	toBig16(v[:], uint16(len(val)))
-	s.w.Write(k[:])
-	s.w.Write([]byte(key))
-	s.w.Write(v[:])
-	s.w.Write([]byte(val))
+	s.block = append(s.block, byte(len(key)>>8), byte(len(key)))
+	s.block = append(s.block, key...)
+	s.block = append(s.block, byte(len(val)>>8), byte(len(val)))
+	s.block = append(s.block, val...)
 }
 
 func (s *compressor) CompressV3(key string, val string) {
-	var k, v [4]byte
-	toBig32(k[:], uint32(len(key)))
-	toBig32(v[:], uint32(len(val)))
-	s.w.Write(k[:])
-	s.w.Write([]byte(key))
-	s.w.Write(v[:])
-	s.w.Write([]byte(val))
+	s.block = append(s.block, byte(len(key)>>24), byte(len(key)>>16), byte(len(key)>>8), byte(len(key)))
+	s.block = append(s.block, key...)
+	s.block = append(s.block, byte(len(val)>>24), byte(len(val)>>16), byte(len(val)>>8), byte(len(val)))
+	s.block = append(s.block, val...)
 }
 
+// Finish compresses the header block and returns the frame with room for
+// the frame header at the start.
 func (s *compressor) Finish() []byte {
-	s.w.Flush()
-	return s.buf.Bytes()
+	pos := 0
+	for i := 0; i < len(s.secrets); i += 2 {
+		s.z.Write(s.block[pos:s.secrets[i]])
+		s.z.WriteSecret(s.block[s.secrets[i]:s.secrets[i+1]])
+		pos = s.secrets[i+1]
+	}
+
+	s.z.Write(s.block[pos:])
+	s.z.Flush()
+	return s.z.out
 }
 
 type frame interface {
@@ -337,6 +403,7 @@ type synStreamFrame struct {
 	ProtoMajor         int
 	ProtoMinor         int
 	Method             string
+	Raw                bool // opened with OpenStream, has no request headers
 }
 
 var invalidSynStreamHeaders = []string{
@@ -363,26 +430,28 @@ func (s *synStreamFrame) WriteFrame(w io.Writer, c *compressor) error {
 		}
 	}
 
-	if err := c.Begin(s.Version, (&[18]byte{})[:], s.Header, 5); err != nil {
-		return err
+	numkeys := 5
+	if s.Raw {
+		numkeys = 0
 	}
 
-	path := s.URL.RequestURI()
-	if !strings.HasPrefix(path, "/") {
-		path = "/" + path
+	if err := c.Begin(s.Version, 18, s.Header, numkeys); err != nil {
+		return err
 	}
 
-	switch s.Version {
-	case 2:
+	switch {
+	case s.Raw:
+		// Only the user's headers are sent
+	case s.Version == 2:
 		c.CompressV2("version", s.Proto)
 		c.CompressV2("method", s.Method)
-		c.CompressV2("url", path)
+		c.CompressV2("url", s.path())
 		c.CompressV2("host", s.URL.Host)
 		c.CompressV2("scheme", s.URL.Scheme)
-	case 3:
+	case s.Version == 3:
 		c.CompressV3(":version", s.Proto)
 		c.CompressV3(":method", s.Method)
-		c.CompressV3(":path", path)
+		c.CompressV3(":path", s.path())
 		c.CompressV3(":host", s.URL.Host)
 		c.CompressV3(":scheme", s.URL.Scheme)
 	default:
@@ -403,6 +472,18 @@ func (s *synStreamFrame) WriteFrame(w io.Writer, c *compressor) error {
 	return err
 }
 
+func (s *synStreamFrame) path() string {
+	if s.Method == "CONNECT" {
+		return s.URL.Host
+	}
+
+	path := s.URL.RequestURI()
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
 func parseSynStream(d []byte, c *decompressor) (*synStreamFrame, error) {
 	if len(d) < 12 {
 		log.Print("spdy: invalid SYN_STREAM length")
@@ -459,26 +540,50 @@ func parseSynStream(d []byte, c *decompressor) (*synStreamFrame, error) {
 		return nil, ErrStreamVersion{sid, s.Version}
 	}
 
+	// Streams opened with OpenStream carry none of the request headers
+	if len(s.Proto) == 0 && len(s.Method) == 0 && len(scheme) == 0 && len(host) == 0 && len(path) == 0 {
+		s.Raw = true
+		return s, nil
+	}
+
 	var ok bool
 	if s.ProtoMajor, s.ProtoMinor, ok = http.ParseHTTPVersion(s.Proto); !ok {
 		log.Printf("spdy: SYN_STREAM could not parse http version %s", s.Proto)
 		return nil, ErrStreamProtocol(sid)
 	}
 
+	if s.Method == "CONNECT" {
+		// CONNECT requests give the target authority in place of the
+		// path.
+		if len(host) == 0 {
+			host = path
+		}
+		if len(host) == 0 || strings.Index(host, "/") >= 0 {
+			log.Printf("spdy: invalid SYN_STREAM CONNECT authority %s", host)
+			return nil, ErrStreamProtocol(sid)
+		}
+		s.URL = &url.URL{Host: host}
+		return s, s.checkHeaders()
+	}
+
 	s.URL, err = url.Parse(fmt.Sprintf("%s://%s%s", scheme, host, path))
 	if err != nil || strings.Index(scheme, ":") >= 0 || strings.Index(host, "/") >= 0 || len(path) == 0 || path[0] != '/' {
 		log.Printf("spdy: invalid SYN_STREAM url %s://%s%s: %v", scheme, host, path, err)
 		return nil, ErrStreamProtocol(sid)
 	}
 
+	return s, s.checkHeaders()
+}
+
+func (s *synStreamFrame) checkHeaders() error {
 	for _, key := range invalidSynStreamHeaders {
 		if s.Header[key] != nil {
 			log.Printf("spdy: invalid SYN_STREAM header %s: %s", key, s.Header.Get(key))
-			return nil, ErrStreamProtocol(sid)
+			return ErrStreamProtocol(s.StreamId)
 		}
 	}
 
-	return s, nil
+	return nil
 }
 
 type synReplyFrame struct {
@@ -490,6 +595,7 @@ type synReplyFrame struct {
 	Proto      string
 	ProtoMajor int
 	ProtoMinor int
+	Raw        bool // reply to a stream opened with OpenStream
 }
 
 var invalidSynReplyHeaders = []string{
@@ -513,19 +619,28 @@ func (s *synReplyFrame) WriteFrame(w io.Writer, c *compressor) error {
 		}
 	}
 
+	numkeys := 2
+	if s.Raw {
+		numkeys = 0
+	}
+
 	switch s.Version {
 	case 2:
-		if err := c.Begin(s.Version, (&[14]byte{})[:], s.Header, 2); err != nil {
+		if err := c.Begin(s.Version, 14, s.Header, numkeys); err != nil {
 			return err
 		}
-		c.CompressV2("status", s.Status)
-		c.CompressV2("version", s.Proto)
+		if !s.Raw {
+			c.CompressV2("status", s.Status)
+			c.CompressV2("version", s.Proto)
+		}
 	case 3:
-		if err := c.Begin(s.Version, (&[12]byte{})[:], s.Header, 2); err != nil {
+		if err := c.Begin(s.Version, 12, s.Header, numkeys); err != nil {
 			return err
 		}
-		c.CompressV3(":status", s.Status)
-		c.CompressV3(":version", s.Proto)
+		if !s.Raw {
+			c.CompressV3(":status", s.Status)
+			c.CompressV3(":version", s.Proto)
+		}
 	default:
 		return ErrSessionVersion(s.Version)
 	}
@@ -577,7 +692,10 @@ func parseSynReply(d []byte, c *decompressor) (*synReplyFrame, error) {
 		return nil, ErrStreamVersion{s.StreamId, s.Version}
 	}
 
-	if len(s.Status) == 0 || len(s.Proto) == 0 {
+	if len(s.Status) == 0 && len(s.Proto) == 0 {
+		s.Raw = true
+		return s, nil
+	} else if len(s.Status) == 0 || len(s.Proto) == 0 {
 		return nil, ErrStreamProtocol(s.StreamId)
 	}
 
@@ -601,6 +719,7 @@ type headersFrame struct {
 	Finished bool
 	StreamId int
 	Header   http.Header
+	Status   string // only used for interim (1xx) responses
 }
 
 func (s *headersFrame) WriteFrame(w io.Writer, c *compressor) error {
@@ -611,15 +730,26 @@ func (s *headersFrame) WriteFrame(w io.Writer, c *compressor) error {
 		flags |= finishedFlag << 24
 	}
 
+	numkeys := 0
+	if s.Status != "" {
+		numkeys++
+	}
+
 	switch s.Version {
 	case 2:
-		if err := c.Begin(s.Version, (&[14]byte{})[:], s.Header, 0); err != nil {
+		if err := c.Begin(s.Version, 14, s.Header, numkeys); err != nil {
 			return err
 		}
+		if s.Status != "" {
+			c.CompressV2("status", s.Status)
+		}
 	case 3:
-		if err := c.Begin(s.Version, (&[12]byte{})[:], s.Header, 0); err != nil {
+		if err := c.Begin(s.Version, 12, s.Header, numkeys); err != nil {
 			return err
 		}
+		if s.Status != "" {
+			c.CompressV3(":status", s.Status)
+		}
 	default:
 		return ErrSessionVersion(s.Version)
 	}
@@ -657,10 +787,12 @@ func parseHeaders(d []byte, c *decompressor) (*headersFrame, error) {
 		if s.Header, err = c.Decompress(s.StreamId, s.Version, d[14:]); err != nil {
 			return nil, err
 		}
+		s.Status = popHeader(s.Header, "Status")
 	case 3:
 		if s.Header, err = c.Decompress(s.StreamId, s.Version, d[12:]); err != nil {
 			return nil, err
 		}
+		s.Status = popHeader(s.Header, ":status")
 	default:
 		return nil, ErrStreamVersion{s.StreamId, s.Version}
 	}
@@ -716,7 +848,9 @@ type windowUpdateFrame struct {
 }
 
 func (s *windowUpdateFrame) WriteFrame(w io.Writer, c *compressor) error {
-	log.Printf("spdy: tx WINDOW_UPDATE %+v", s)
+	if LogDataFrames {
+		log.Printf("spdy: tx WINDOW_UPDATE %+v", s)
+	}
 	h := [16]byte{}
 	toBig32(h[0:], windowUpdateCode|uint32(s.Version<<16))
 	toBig32(h[4:], 8) // length and no flags
@@ -923,10 +1057,21 @@ type dataFrame struct {
 	Finished   bool
 	Compressed bool
 	Data       []byte
+
+	hdr [8]byte                  // encoded header, kept here so it isn't allocated
+	buf *[maxDataPacketSize]byte // pooled storage for Data, see stream.newDataFrame
+}
+
+// String leaves out the payload so that logging DATA frames stays cheap.
+func (s *dataFrame) String() string {
+	return fmt.Sprintf("{StreamId:%d Finished:%v Compressed:%v Data:%d bytes}",
+		s.StreamId, s.Finished, s.Compressed, len(s.Data))
 }
 
 func (s *dataFrame) WriteFrame(w io.Writer, c *compressor) error {
-	log.Printf("spdy: tx DATA %+v %s", s, s.Data)
+	if LogDataFrames {
+		log.Printf("spdy: tx DATA %v", s)
+	}
 
 	flags := uint32(0)
 	if s.Finished {
@@ -936,11 +1081,10 @@ func (s *dataFrame) WriteFrame(w io.Writer, c *compressor) error {
 		flags |= compressedFlag << 24
 	}
 
-	h := [8]byte{}
-	toBig32(h[0:], uint32(s.StreamId))
-	toBig32(h[4:], flags|uint32(len(s.Data)))
+	toBig32(s.hdr[0:], uint32(s.StreamId))
+	toBig32(s.hdr[4:], flags|uint32(len(s.Data)))
 
-	if _, err := w.Write(h[:]); err != nil {
+	if _, err := w.Write(s.hdr[:]); err != nil {
 		return err
 	}
 
@@ -951,8 +1095,10 @@ func (s *dataFrame) WriteFrame(w io.Writer, c *compressor) error {
 	return nil
 }
 
-func parseData(d []byte) (*dataFrame, error) {
-	s := &dataFrame{
+// parseData parses d into s so that the rx thread can reuse the same frame.
+// The payload is left in d.
+func parseData(d []byte, s *dataFrame) error {
+	*s = dataFrame{
 		StreamId:   int(fromBig32(d[0:])),
 		Finished:   (d[4] & finishedFlag) != 0,
 		Compressed: (d[4] & compressedFlag) != 0,
@@ -960,8 +1106,8 @@ func parseData(d []byte) (*dataFrame, error) {
 	}
 
 	if s.StreamId < 0 {
-		return nil, ErrStreamProtocol(s.StreamId)
+		return ErrStreamProtocol(s.StreamId)
 	}
 
-	return s, nil
+	return nil
 }
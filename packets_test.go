@@ -149,3 +149,43 @@ func TestHeadersFrame(t *testing.T) {
 		})
 	}
 }
+
+func TestHeaderAllocs(t *testing.T) {
+	header := http.Header{
+		"Content-Type": {"text/html"},
+		"Set-Cookie":   {"a=1", "b=2"},
+	}
+
+	zip := compressor{}
+	unzip := decompressor{}
+	var got http.Header
+	var err error
+
+	roundTrip := func() {
+		zip.Begin(3, 12, header, 0)
+		got, err = unzip.Decompress(1, 3, zip.Finish()[12:])
+	}
+
+	// Warm up the buffers
+	roundTrip()
+
+	// Decompressing allocates the header map, and for each header the
+	// key, the values and the slice holding them. Compressing shouldn't
+	// allocate at all.
+	n := testing.AllocsPerRun(100, roundTrip)
+	if max := 2 + 3*float64(len(header)); n > max {
+		t.Errorf("header round trip allocated %v times, expected at most %v", n, max)
+	}
+
+	if err != nil || !reflect.DeepEqual(got, header) {
+		t.Fatalf("got %v %v, expected %v", got, err, header)
+	}
+
+	n = testing.AllocsPerRun(100, func() {
+		zip.Begin(3, 12, header, 0)
+		zip.Finish()
+	})
+	if n != 0 {
+		t.Errorf("compression allocated %v times", n)
+	}
+}
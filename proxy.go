@@ -0,0 +1,277 @@
+package spdy
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// hopHeaders are the headers that only apply to a single connection and
+// must not be forwarded by a proxy.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders removes the hop by hop headers along with any headers
+// named in the Connection header.
+func removeHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, key := range strings.Split(v, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				h.Del(key)
+			}
+		}
+	}
+
+	for _, key := range hopHeaders {
+		h.Del(key)
+	}
+}
+
+var defaultProxyTransport = &Transport{
+	Proxy: http.ProxyFromEnvironment,
+	FallbackClient: &http.Client{
+		// Redirects are for the client to follow
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	},
+}
+
+// ForwardProxy is a http.Handler that acts as a forward proxy. It is intended
+// to be served over a SPDY connection so that a client can multiplex requests
+// for many origins over a single session (see Transport.SpdyProxy).
+//
+// Requests for absolute URLs are forwarded upstream using Transport. CONNECT
+// requests are tunnelled, with the stream's request and response data
+// carrying the tunnel.
+//
+// If neither AllowClientCert nor AllowUser is set then the proxy is open to
+// anyone who can connect to it.
+type ForwardProxy struct {
+	// Transport is used to forward requests upstream. If nil a spdy
+	// Transport which falls back to HTTP/1.1 is used.
+	Transport http.RoundTripper
+
+	// Dial is used to connect to CONNECT targets. If nil net.Dial is
+	// used.
+	Dial func(network, addr string) (net.Conn, error)
+
+	// AllowClientCert, if set, is called with the client's verified TLS
+	// certificate. Returning true allows the request.
+	AllowClientCert func(cert *x509.Certificate) bool
+
+	// AllowUser, if set, is called with the credentials from the
+	// Proxy-Authorization header. Returning true allows the request.
+	AllowUser func(user, password string) bool
+
+	// Realm is sent in the Proxy-Authenticate challenge when AllowUser
+	// is set.
+	Realm string
+}
+
+// allowed checks whether the client is allowed to use the proxy. If neither
+// of the access checks are set then all clients are allowed. Otherwise
+// either check passing allows the client.
+func (p *ForwardProxy) allowed(r *http.Request) bool {
+	if p.AllowClientCert == nil && p.AllowUser == nil {
+		return true
+	}
+
+	if p.AllowClientCert != nil && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		if p.AllowClientCert(r.TLS.VerifiedChains[0][0]) {
+			return true
+		}
+	}
+
+	if p.AllowUser != nil {
+		if user, pass, ok := parseBasicAuth(r.Header.Get("Proxy-Authorization")); ok {
+			return p.AllowUser(user, pass)
+		}
+	}
+
+	return false
+}
+
+func parseBasicAuth(auth string) (user, pass string, ok bool) {
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", "", false
+	}
+
+	data, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+
+	split := strings.SplitN(string(data), ":", 2)
+	if len(split) != 2 {
+		return "", "", false
+	}
+
+	return split[0], split[1], true
+}
+
+func (p *ForwardProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !p.allowed(r) {
+		if p.AllowUser != nil {
+			realm := p.Realm
+			if realm == "" {
+				realm = "proxy"
+			}
+			w.Header().Set("Proxy-Authenticate", `Basic realm="`+realm+`"`)
+			http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+		} else {
+			http.Error(w, "forbidden", http.StatusForbidden)
+		}
+		return
+	}
+
+	if r.Method == "CONNECT" {
+		p.serveConnect(w, r)
+		return
+	}
+
+	if r.URL.Scheme == "" || r.URL.Host == "" {
+		http.Error(w, "proxy requests must use an absolute URL", http.StatusBadRequest)
+		return
+	}
+
+	out := new(http.Request)
+	*out = *r
+	out.Header = r.Header.Clone()
+	out.RequestURI = ""
+	out.Host = r.URL.Host
+	removeHopHeaders(out.Header)
+
+	if r.ContentLength == 0 {
+		out.Body = nil
+	}
+
+	transport := p.Transport
+	if transport == nil {
+		transport = defaultProxyTransport
+	}
+
+	resp, err := transport.RoundTrip(out)
+	if err != nil {
+		log.Printf("spdy: proxy error for %s: %v", r.URL, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	removeHopHeaders(resp.Header)
+	for key, vals := range resp.Header {
+		w.Header()[key] = vals
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	// Send the body through as it arrives
+	copyFlush(w, resp.Body)
+}
+
+// copyFlush copies data from r to w flushing after each read.
+func copyFlush(w io.Writer, r io.Reader) error {
+	f, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+			if f != nil {
+				f.Flush()
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// serveConnect tunnels the request data to the target and sends back the
+// target's data as the response. Once the client finishes its side of the
+// stream the write side of the target connection is closed, and vice versa.
+func (p *ForwardProxy) serveConnect(w http.ResponseWriter, r *http.Request) {
+	dial := p.Dial
+	if dial == nil {
+		dial = net.Dial
+	}
+
+	remote, err := dial("tcp", r.URL.Host)
+	if err != nil {
+		log.Printf("spdy: proxy CONNECT error for %s: %v", r.URL.Host, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer remote.Close()
+
+	// SPDY streams send the reply as part of the hijack, HTTP/1.1
+	// connections need it written out.
+	if h, ok := w.(http.Hijacker); ok {
+		_, isStream := w.(Stream)
+
+		sock, buf, err := h.Hijack()
+		if err != nil {
+			return
+		}
+		defer sock.Close()
+
+		if !isStream {
+			io.WriteString(sock, "HTTP/1.1 200 Connection established\r\n\r\n")
+		}
+
+		done := make(chan bool)
+		go func() {
+			io.Copy(remote, buf)
+			if cw, ok := remote.(closeWriter); ok {
+				cw.CloseWrite()
+			}
+			close(done)
+		}()
+
+		io.Copy(sock, remote)
+		if cw, ok := sock.(closeWriter); ok {
+			cw.CloseWrite()
+		}
+
+		// Wait for the client to finish its side
+		<-done
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	go func() {
+		io.Copy(remote, r.Body)
+		if cw, ok := remote.(closeWriter); ok {
+			cw.CloseWrite()
+		}
+	}()
+
+	copyFlush(w, remote)
+}
@@ -0,0 +1,691 @@
+package spdy
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testProxy is a stand-in HTTP proxy that only supports CONNECT.
+type testProxy struct {
+	listener net.Listener
+	scheme   string
+	auth     func(r *http.Request) bool
+
+	lk       sync.Mutex
+	requests []*http.Request
+}
+
+func newTestProxy(t *testing.T, auth func(r *http.Request) bool) *testProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testProxy{listener: l, scheme: "http", auth: auth}
+	go p.serve()
+	return p
+}
+
+// newTestTLSProxy is like newTestProxy but the client has to speak TLS to the
+// proxy using the certificate from cfg.
+func newTestTLSProxy(t *testing.T, cfg *tls.Config, auth func(r *http.Request) bool) *testProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testProxy{listener: tls.NewListener(l, cfg), scheme: "https", auth: auth}
+	go p.serve()
+	return p
+}
+
+func (p *testProxy) URL() *url.URL {
+	return &url.URL{Scheme: p.scheme, Host: p.listener.Addr().String()}
+}
+
+func (p *testProxy) Close() {
+	p.listener.Close()
+}
+
+func (p *testProxy) serve() {
+	for {
+		sock, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		go p.serveConn(sock)
+	}
+}
+
+func (p *testProxy) serveConn(sock net.Conn) {
+	defer sock.Close()
+
+	br := bufio.NewReader(sock)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return
+	}
+
+	p.lk.Lock()
+	p.requests = append(p.requests, req)
+	p.lk.Unlock()
+
+	if req.Method != "CONNECT" {
+		io.WriteString(sock, "HTTP/1.1 405 Method Not Allowed\r\n\r\n")
+		return
+	}
+
+	if p.auth != nil && !p.auth(req) {
+		io.WriteString(sock, "HTTP/1.1 407 Proxy Authentication Required\r\n"+
+			"Proxy-Authenticate: Basic realm=\"test\"\r\n\r\n")
+		return
+	}
+
+	remote, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		io.WriteString(sock, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		return
+	}
+	defer remote.Close()
+
+	io.WriteString(sock, "HTTP/1.1 200 OK\r\n\r\n")
+	pipe(sock, br, remote)
+}
+
+// pipe copies data both ways between the client and remote until either side
+// closes. Client data is read from r which may have buffered data.
+func pipe(client io.Writer, r io.Reader, remote io.ReadWriter) {
+	done := make(chan bool, 2)
+	go func() {
+		io.Copy(remote, r)
+		done <- true
+	}()
+	go func() {
+		io.Copy(client, remote)
+		done <- true
+	}()
+	<-done
+}
+
+func TestProxyBasicAuth(t *testing.T) {
+	srv, tr := newTestServer(t, 3, helloHandler)
+	defer srv.Close()
+
+	proxy := newTestProxy(t, func(r *http.Request) bool {
+		return r.Header.Get("Proxy-Authorization") == "Basic dXNlcjpzZWNyZXQ="
+	})
+	defer proxy.Close()
+
+	u := proxy.URL()
+	u.User = url.UserPassword("user", "secret")
+	tr.Proxy = http.ProxyURL(u)
+
+	if got := testGet(t, tr, srv.URL+"/foo"); got != "hello /foo" {
+		t.Fatalf("got %q", got)
+	}
+
+	conns := tr.Connections()
+	if len(conns) != 1 || conns[0].Proxy != "http://user:xxxxx@"+u.Host {
+		t.Fatalf("unexpected connections %+v", conns)
+	}
+}
+
+func TestProxyConnectHeader(t *testing.T) {
+	srv, tr := newTestServer(t, 3, helloHandler)
+	defer srv.Close()
+
+	proxy := newTestProxy(t, func(r *http.Request) bool {
+		return r.Header.Get("X-Token") == "abc" && r.Header.Get("X-Target") == r.Host
+	})
+	defer proxy.Close()
+
+	tr.Proxy = http.ProxyURL(proxy.URL())
+	tr.ProxyConnectHeader = http.Header{"X-Token": {"abc"}}
+	tr.GetProxyConnectHeader = func(proxy *url.URL, target string) (http.Header, error) {
+		return http.Header{"X-Target": {target}}, nil
+	}
+
+	if got := testGet(t, tr, srv.URL+"/foo"); got != "hello /foo" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestProxyAuthRequired(t *testing.T) {
+	srv, tr := newTestServer(t, 3, helloHandler)
+	defer srv.Close()
+
+	proxy := newTestProxy(t, func(r *http.Request) bool { return false })
+	defer proxy.Close()
+
+	tr.Proxy = http.ProxyURL(proxy.URL())
+
+	req, _ := http.NewRequest("GET", srv.URL+"/", nil)
+	_, err := tr.RoundTrip(req)
+
+	perr, ok := err.(*ErrProxyAuthRequired)
+	if !ok {
+		t.Fatalf("expected ErrProxyAuthRequired, got %v", err)
+	}
+	if perr.Proxy != proxy.URL().Host || !reflect.DeepEqual(perr.Challenge, []string{`Basic realm="test"`}) {
+		t.Fatalf("unexpected error %+v", perr)
+	}
+}
+
+// testSocksProxy is a stand-in SOCKS5 proxy. Domain names are resolved using
+// the hosts map so that tests can check that lookups are done remotely.
+type testSocksProxy struct {
+	listener net.Listener
+	user     *url.Userinfo
+	hosts    map[string]string
+}
+
+func newTestSocksProxy(t *testing.T, user *url.Userinfo, hosts map[string]string) *testSocksProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testSocksProxy{listener: l, user: user, hosts: hosts}
+	go p.serve()
+	return p
+}
+
+func (p *testSocksProxy) URL() *url.URL {
+	return &url.URL{Scheme: "socks5", Host: p.listener.Addr().String(), User: p.user}
+}
+
+func (p *testSocksProxy) Close() {
+	p.listener.Close()
+}
+
+func (p *testSocksProxy) serve() {
+	for {
+		sock, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		go p.serveConn(sock)
+	}
+}
+
+func (p *testSocksProxy) serveConn(sock net.Conn) {
+	defer sock.Close()
+
+	var h [2]byte
+	if _, err := io.ReadFull(sock, h[:]); err != nil {
+		return
+	}
+	methods := make([]byte, h[1])
+	if _, err := io.ReadFull(sock, methods); err != nil {
+		return
+	}
+
+	if p.user == nil {
+		sock.Write([]byte{5, 0})
+	} else {
+		sock.Write([]byte{5, 2})
+
+		var v [2]byte
+		io.ReadFull(sock, v[:])
+		name := make([]byte, v[1])
+		io.ReadFull(sock, name)
+		io.ReadFull(sock, v[:1])
+		pass := make([]byte, v[0])
+		io.ReadFull(sock, pass)
+
+		want, _ := p.user.Password()
+		if string(name) != p.user.Username() || string(pass) != want {
+			sock.Write([]byte{1, 1})
+			return
+		}
+		sock.Write([]byte{1, 0})
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(sock, req[:]); err != nil {
+		return
+	}
+
+	var host string
+	switch req[3] {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(sock, ip)
+		host = net.IP(ip).String()
+	case 3:
+		var n [1]byte
+		io.ReadFull(sock, n[:])
+		name := make([]byte, n[0])
+		io.ReadFull(sock, name)
+		host = p.hosts[string(name)]
+	case 4:
+		ip := make([]byte, 16)
+		io.ReadFull(sock, ip)
+		host = net.IP(ip).String()
+	}
+
+	var port [2]byte
+	io.ReadFull(sock, port[:])
+
+	remote, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))))
+	if err != nil {
+		sock.Write([]byte{5, 4, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer remote.Close()
+
+	sock.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+	pipe(sock, sock, remote)
+}
+
+func TestSocksProxy(t *testing.T) {
+	srv, tr := newTestServer(t, 3, helloHandler)
+	defer srv.Close()
+
+	// The test certificate is valid for example.com which only the proxy
+	// knows how to resolve.
+	proxy := newTestSocksProxy(t, url.UserPassword("user", "secret"), map[string]string{
+		"example.com": "127.0.0.1",
+	})
+	defer proxy.Close()
+
+	tr.Proxy = http.ProxyURL(proxy.URL())
+
+	dialed := ""
+	tr.Dial = func(network, addr string) (net.Conn, error) {
+		dialed = addr
+		return net.Dial(network, addr)
+	}
+
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	if got := testGet(t, tr, "https://example.com:"+port+"/foo"); got != "hello /foo" {
+		t.Fatalf("got %q", got)
+	}
+
+	if dialed != proxy.URL().Host {
+		t.Fatalf("dial override not used, dialed %q", dialed)
+	}
+}
+
+func TestSocksProxyBadPassword(t *testing.T) {
+	srv, tr := newTestServer(t, 3, helloHandler)
+	defer srv.Close()
+
+	proxy := newTestSocksProxy(t, url.UserPassword("user", "secret"), nil)
+	defer proxy.Close()
+
+	u := proxy.URL()
+	u.User = url.UserPassword("user", "wrong")
+	tr.Proxy = http.ProxyURL(u)
+
+	req, _ := http.NewRequest("GET", srv.URL+"/", nil)
+	if _, err := tr.RoundTrip(req); err != ErrSocksAuth {
+		t.Fatalf("expected ErrSocksAuth, got %v", err)
+	}
+}
+
+func TestHTTPSProxy(t *testing.T) {
+	srv, tr := newTestServer(t, 3, helloHandler)
+	defer srv.Close()
+
+	proxy := newTestTLSProxy(t, &tls.Config{Certificates: srv.TLS.Certificates}, nil)
+	defer proxy.Close()
+
+	tr.Proxy = http.ProxyURL(proxy.URL())
+
+	if got := testGet(t, tr, srv.URL+"/foo"); got != "hello /foo" {
+		t.Fatalf("got %q", got)
+	}
+
+	proxy.lk.Lock()
+	n := len(proxy.requests)
+	proxy.lk.Unlock()
+	if n != 1 {
+		t.Fatalf("expected 1 CONNECT request, got %d", n)
+	}
+}
+
+func TestSpdyProxy(t *testing.T) {
+	// The proxy is just a SPDY server that echos back the URL it was
+	// asked for.
+	proxy, tr := newTestServer(t, 3, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.URL, r.Header.Get("Proxy-Authorization"))
+	}))
+	defer proxy.Close()
+
+	u, _ := url.Parse(proxy.URL)
+	u.User = url.UserPassword("user", "secret")
+	tr.Proxy = http.ProxyURL(u)
+	tr.SpdyProxy = true
+
+	for _, target := range []string{"https://a.example.com/foo", "http://b.example.com:8080/bar?x=1"} {
+		if got, want := testGet(t, tr, target), target+" Basic dXNlcjpzZWNyZXQ="; got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+
+	conns := tr.Connections()
+	if len(conns) != 1 || conns[0].Origin != "" {
+		t.Fatalf("expected a single proxy session, got %+v", conns)
+	}
+}
+
+func TestSpdyProxyFallback(t *testing.T) {
+	srv, tr := newTestServer(t, 3, helloHandler)
+	defer srv.Close()
+
+	// The stand-in proxy only speaks HTTP/1.1 so we should tunnel.
+	proxy := newTestTLSProxy(t, &tls.Config{Certificates: srv.TLS.Certificates}, nil)
+	defer proxy.Close()
+
+	tr.Proxy = http.ProxyURL(proxy.URL())
+	tr.SpdyProxy = true
+
+	for i := 0; i < 2; i++ {
+		if got := testGet(t, tr, srv.URL+"/foo"); got != "hello /foo" {
+			t.Fatalf("got %q", got)
+		}
+	}
+
+	conns := tr.Connections()
+	if len(conns) != 1 || conns[0].Origin != srv.URL {
+		t.Fatalf("expected a tunnelled connection, got %+v", conns)
+	}
+}
+
+// newTestForwardProxy starts a SPDY ForwardProxy which trusts the test
+// server certificates upstream and returns a Transport using it.
+func newTestForwardProxy(t *testing.T, p *ForwardProxy) (*httptest.Server, *Transport) {
+	srv, tr := newTestServer(t, 3, p)
+	p.Transport = &Transport{
+		TLSClientConfig: tr.TLSClientConfig,
+		FallbackClient:  &http.Client{},
+	}
+
+	u, _ := url.Parse(srv.URL)
+	tr.Proxy = http.ProxyURL(u)
+	tr.SpdyProxy = true
+	tr.FallbackClient = &http.Client{}
+	return srv, tr
+}
+
+var echoHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Proxy-Auth", r.Header.Get("Proxy-Authorization"))
+	fmt.Fprintf(w, "%s %s ", r.Method, r.URL.Path)
+	io.Copy(w, r.Body)
+})
+
+func TestForwardProxy(t *testing.T) {
+	spdyOrigin, _ := newTestServer(t, 3, echoHandler)
+	defer spdyOrigin.Close()
+	httpOrigin := httptest.NewServer(echoHandler)
+	defer httpOrigin.Close()
+
+	proxy, tr := newTestForwardProxy(t, &ForwardProxy{})
+	defer proxy.Close()
+
+	for _, origin := range []string{spdyOrigin.URL, httpOrigin.URL} {
+		req, _ := http.NewRequest("POST", origin+"/foo", strings.NewReader("some data"))
+		req.Header.Set("Proxy-Authorization", "Basic Zm9vOmJhcg==")
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if string(data) != "POST /foo some data" {
+			t.Fatalf("%s: got %q", origin, data)
+		}
+		if resp.Header.Get("X-Proxy-Auth") != "" {
+			t.Fatalf("%s: Proxy-Authorization forwarded", origin)
+		}
+	}
+
+	if conns := tr.Connections(); len(conns) != 1 {
+		t.Fatalf("expected a single proxy session, got %+v", conns)
+	}
+}
+
+func TestForwardProxyAuth(t *testing.T) {
+	origin := httptest.NewServer(echoHandler)
+	defer origin.Close()
+
+	proxy, tr := newTestForwardProxy(t, &ForwardProxy{
+		AllowUser: func(user, pass string) bool {
+			return user == "user" && pass == "secret"
+		},
+	})
+	defer proxy.Close()
+
+	req, _ := http.NewRequest("GET", origin.URL+"/", nil)
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusProxyAuthRequired || resp.Header.Get("Proxy-Authenticate") != `Basic realm="proxy"` {
+		t.Fatalf("expected a 407 challenge, got %d %v", resp.StatusCode, resp.Header)
+	}
+
+	u, _ := url.Parse(proxy.URL)
+	u.User = url.UserPassword("user", "secret")
+	tr.Proxy = http.ProxyURL(u)
+
+	if got := testGet(t, tr, origin.URL+"/foo"); got != "GET /foo " {
+		t.Fatalf("got %q", got)
+	}
+}
+
+// newTestCert creates a self-signed certificate for 127.0.0.1 which can be
+// used by both the server and the client.
+func newTestCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, pool
+}
+
+func TestForwardProxyClientCertFallback(t *testing.T) {
+	origin := httptest.NewServer(echoHandler)
+	defer origin.Close()
+
+	cert, pool := newTestCert(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	proxy := &ForwardProxy{
+		AllowClientCert: func(c *x509.Certificate) bool {
+			return c.Subject.CommonName == "test"
+		},
+	}
+	go ServeTLS(l, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}, proxy)
+
+	// Clients which only speak HTTP/1.1 end up on the fallback server and
+	// should still be allowed by their certificate.
+	for _, certs := range [][]tls.Certificate{nil, {cert}} {
+		tr := &http.Transport{
+			Proxy: http.ProxyURL(&url.URL{Scheme: "https", Host: l.Addr().String()}),
+			TLSClientConfig: &tls.Config{
+				RootCAs:      pool,
+				Certificates: certs,
+			},
+		}
+		req, _ := http.NewRequest("GET", origin.URL+"/foo", nil)
+		resp, err := tr.RoundTrip(req)
+		tr.CloseIdleConnections()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		want := http.StatusForbidden
+		if certs != nil {
+			want = http.StatusOK
+		}
+		if resp.StatusCode != want || (certs != nil && string(data) != "GET /foo ") {
+			t.Fatalf("with %d client certs: got %d %q", len(certs), resp.StatusCode, data)
+		}
+	}
+}
+
+func TestForwardProxyConnect(t *testing.T) {
+	// Echo server as the tunnel target
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			sock, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(sock, sock)
+				sock.Close()
+			}()
+		}
+	}()
+
+	proxy, tr := newTestForwardProxy(t, &ForwardProxy{})
+	defer proxy.Close()
+
+	cfg := tr.TLSClientConfig.Clone()
+	cfg.NextProtos = []string{"spdy/3"}
+	sock, err := tls.Dial("tcp", proxy.Listener.Addr().String(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewConnection(sock, nil, 3, false)
+	go c.Run()
+	defer c.Close()
+
+	pr, pw := io.Pipe()
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Host: l.Addr().String()},
+		Proto:  "HTTP/1.1",
+		Header: make(http.Header),
+		Body:   pr,
+	}
+
+	resp, err := c.startRequest(nil, req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT failed with %s", resp.Status)
+	}
+
+	buf := make([]byte, 4)
+	for _, msg := range []string{"ping", "pong"} {
+		io.WriteString(pw, msg)
+		if _, err := io.ReadFull(resp.Body, buf); err != nil || string(buf) != msg {
+			t.Fatalf("got %q %v", buf, err)
+		}
+	}
+
+	// Closing our side should close the tunnel
+	pw.Close()
+	if data, err := ioutil.ReadAll(resp.Body); err != nil || len(data) != 0 {
+		t.Fatalf("expected a clean close, got %q %v", data, err)
+	}
+	resp.Body.Close()
+}
+
+func TestTransportConnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			sock, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(sock, sock)
+				sock.Close()
+			}()
+		}
+	}()
+
+	proxy, tr := newTestForwardProxy(t, &ForwardProxy{})
+	defer proxy.Close()
+	tr.Proxy = nil
+
+	req, _ := http.NewRequest("CONNECT", proxy.URL, nil)
+	req.Host = l.Addr().String()
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	tunnel := resp.Body.(io.ReadWriteCloser)
+	buf := make([]byte, 4)
+	for _, msg := range []string{"ping", "pong"} {
+		io.WriteString(tunnel, msg)
+		if _, err := io.ReadFull(tunnel, buf); err != nil || string(buf) != msg {
+			t.Fatalf("got %q %v", buf, err)
+		}
+	}
+
+	tunnel.(closeWriter).CloseWrite()
+	if data, err := ioutil.ReadAll(tunnel); err != nil || len(data) != 0 {
+		t.Fatalf("expected a clean close, got %q %v", data, err)
+	}
+}
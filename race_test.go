@@ -0,0 +1,7 @@
+//go:build race
+
+package spdy
+
+// The race detector makes sync.Pool drop items at random, which breaks the
+// allocation tests.
+const raceEnabled = true
@@ -0,0 +1,226 @@
+package spdy
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// maxPendingStreams is the number of raw streams opened by the remote that
+// are queued waiting for AcceptStream before further ones are refused.
+const maxPendingStreams = 16
+
+// RawStream is a full duplex stream opened with Connection.OpenStream or
+// received with Connection.AcceptStream. Unlike requests it has no HTTP
+// semantics, the SYN_STREAM and SYN_REPLY carry only the headers given by
+// the user. This is useful for multiplexing other protocols (eg remote
+// command stdin/stdout or port forwarding) over a connection.
+//
+// Data is sent without buffering and is subject to the usual flow control
+// and prioritization. Close must be called to release the stream, even if
+// both sides have been half closed.
+type RawStream stream
+
+var _ net.Conn = (*RawStream)(nil)
+
+// OpenStream opens a new raw stream to the remote, which it receives with
+// AcceptStream. It returns once the SYN_STREAM has been queued, use
+// ReplyHeader to wait for the remote to accept it.
+func (c *Connection) OpenStream(header http.Header, priority int) (*RawStream, error) {
+	if header == nil {
+		header = make(http.Header)
+	}
+
+	s := c.newStream(nil, false, &RequestExtra{Priority: priority})
+	s.raw = true
+	s.rawHeader = header
+
+	select {
+	case <-c.onGoAway:
+		return nil, ErrGoAway
+	case c.onStartRequest <- s:
+	}
+
+	if err := <-c.onRequestStarted; err != nil {
+		return nil, err
+	}
+
+	return (*RawStream)(s), nil
+}
+
+// SetAcceptStreams sets whether raw streams opened by the remote are queued
+// for AcceptStream. By default they are reset with PROTOCOL_ERROR, the same
+// as any other SYN_STREAM without request headers, so that a remote can't
+// park streams on a connection that is never going to accept them. It must
+// be called before Run.
+func (c *Connection) SetAcceptStreams(accept bool) {
+	c.acceptStreams = accept
+}
+
+// AcceptStream waits for the remote to open a raw stream with OpenStream.
+// Streams are refused if too many are waiting to be accepted. It never
+// returns a stream unless SetAcceptStreams has been called.
+func (c *Connection) AcceptStream() (*RawStream, error) {
+	select {
+	case s := <-c.accepted:
+		return (*RawStream)(s), nil
+	case <-c.closed:
+	}
+
+	// Pick up any streams that came in just before the close
+	select {
+	case s := <-c.accepted:
+		return (*RawStream)(s), nil
+	default:
+		return nil, ErrConnectionClosed
+	}
+}
+
+// handleRawStream queues a raw stream for AcceptStream. It is called on the
+// dispatch thread once the SYN_STREAM has passed the common checks.
+func (c *Connection) handleRawStream(f *synStreamFrame) error {
+	if !c.acceptStreams || f.AssociatedStreamId != 0 {
+		return ErrStreamProtocol(f.StreamId)
+	}
+
+	extra := &RequestExtra{
+		Unidirectional: f.Finished,
+		Priority:       f.Priority,
+	}
+
+	s := c.newStream(nil, f.Unidirectional, extra)
+	s.streamId = f.StreamId
+	s.txWindow = c.txWindow
+	c.initReceiveWindow(s)
+	s.isRecipient = true
+	s.raw = true
+	s.rawHeader = f.Header
+
+	// The stream belongs to the user once it is queued
+	registered := !(s.txFinished && s.rxFinished)
+	if registered {
+		c.streams[f.StreamId] = s
+	}
+
+	select {
+	case c.accepted <- s:
+		return nil
+	default:
+		if registered {
+			delete(c.streams, f.StreamId)
+		}
+		return ErrRefusedStream(f.StreamId)
+	}
+}
+
+// StreamId returns the SPDY stream id.
+func (s *RawStream) StreamId() int {
+	return s.streamId
+}
+
+// Header returns the headers sent with the SYN_STREAM.
+func (s *RawStream) Header() http.Header {
+	return s.rawHeader
+}
+
+// ReplyHeader waits for the remote to reply to a stream opened with
+// OpenStream and returns the headers it sent. For accepted streams it
+// returns the headers that were sent with Reply.
+func (s *RawStream) ReplyHeader() (http.Header, error) {
+	if s.isRecipient {
+		return s.replyHeader, nil
+	}
+
+	s.rxLock.Lock()
+	defer s.rxLock.Unlock()
+
+	for s.rxResponse == nil && s.rxError == nil {
+		s.rxCond.Wait()
+	}
+
+	if s.rxResponse == nil {
+		return nil, s.rxError
+	}
+
+	return s.rxResponse.Header, nil
+}
+
+// Reply accepts a stream received with AcceptStream, sending the SYN_REPLY
+// with the given headers. If it isn't called an empty reply is sent with
+// the first write or close. It does nothing for opened streams or if the
+// reply has already been sent.
+func (s *RawStream) Reply(header http.Header) error {
+	s.txUserLock.Lock()
+	defer s.txUserLock.Unlock()
+
+	if s.isRecipient && !s.replySent {
+		s.replyHeader = header
+	}
+
+	return (*stream)(s).sendReplyIfNeeded(false)
+}
+
+// Read reads data sent by the remote. It returns io.EOF once the remote has
+// closed its side of the stream.
+func (s *RawStream) Read(buf []byte) (int, error) {
+	return (*streamConn)(s).Read(buf)
+}
+
+// Write sends data to the remote. It blocks whilst the remote's flow
+// control window is full.
+func (s *RawStream) Write(data []byte) (int, error) {
+	return (*streamConn)(s).Write(data)
+}
+
+// CloseWrite half closes the stream, the remote will then read io.EOF.
+// Data can still be read until the remote closes its side.
+func (s *RawStream) CloseWrite() error {
+	return (*streamConn)(s).CloseWrite()
+}
+
+// Close closes both sides of the stream. Streams opened with OpenStream are
+// reset if the remote hasn't yet closed its side.
+func (s *RawStream) Close() error {
+	return (*streamConn)(s).Close()
+}
+
+// Reset aborts the stream in both directions by sending a RST_STREAM.
+// Pending reads and writes on both ends fail. It is safe to call
+// concurrently with Read and Write.
+func (s *RawStream) Reset() error {
+	select {
+	case s.connection.onStreamReset <- (*stream)(s):
+	case <-s.connection.closed:
+	}
+	return nil
+}
+
+// SetPriority changes the priority of data sent on the stream.
+func (s *RawStream) SetPriority(priority int) {
+	(*streamTxUser)(s).SetPriority(priority)
+}
+
+// Priority returns the priority of data sent on the stream.
+func (s *RawStream) Priority() int {
+	return (*streamTxUser)(s).Priority()
+}
+
+func (s *RawStream) LocalAddr() net.Addr {
+	return (*streamConn)(s).LocalAddr()
+}
+
+func (s *RawStream) RemoteAddr() net.Addr {
+	return (*streamConn)(s).RemoteAddr()
+}
+
+func (s *RawStream) SetDeadline(t time.Time) error {
+	return (*streamConn)(s).SetDeadline(t)
+}
+
+func (s *RawStream) SetReadDeadline(t time.Time) error {
+	return (*streamConn)(s).SetReadDeadline(t)
+}
+
+func (s *RawStream) SetWriteDeadline(t time.Time) error {
+	return (*streamConn)(s).SetWriteDeadline(t)
+}
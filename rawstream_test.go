@@ -0,0 +1,217 @@
+package spdy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// newConnectionPair returns a client and server connection talking to each
+// other over a pipe. Neither has a request handler and both accept raw
+// streams.
+func newConnectionPair(t *testing.T, version int) (client, server *Connection) {
+	a, b := net.Pipe()
+	client = NewConnection(a, nil, version, false)
+	server = NewConnection(b, nil, version, true)
+	client.SetAcceptStreams(true)
+	server.SetAcceptStreams(true)
+	go client.Run()
+	go server.Run()
+	return client, server
+}
+
+func TestRawStream(t *testing.T) {
+	for _, version := range []int{2, 3} {
+		client, server := newConnectionPair(t, version)
+
+		// Streams can be opened in either direction
+		for _, c := range [][2]*Connection{{client, server}, {server, client}} {
+			opener, acceptor := c[0], c[1]
+
+			s1, err := opener.OpenStream(http.Header{"Channel": {"stdout"}}, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s2, err := acceptor.AcceptStream()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if s2.Header().Get("Channel") != "stdout" || s2.StreamId() != s1.StreamId() {
+				t.Fatalf("v%d: unexpected stream %d %+v", version, s2.StreamId(), s2.Header())
+			}
+
+			if err := s2.Reply(http.Header{"Accepted": {"yes"}}); err != nil {
+				t.Fatal(err)
+			}
+
+			if h, err := s1.ReplyHeader(); err != nil || h.Get("Accepted") != "yes" {
+				t.Fatalf("v%d: got reply %+v %v", version, h, err)
+			}
+
+			// Larger than the initial window so that flow control
+			// kicks in
+			data := bytes.Repeat([]byte("0123456789"), 20*1024)
+			go func() {
+				s1.Write(data)
+				s1.CloseWrite()
+			}()
+
+			got, err := ioutil.ReadAll(s2)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("v%d: got %d bytes %v", version, len(got), err)
+			}
+
+			// The other direction is still open after the half
+			// close
+			io.WriteString(s2, "done")
+			s2.Close()
+
+			if got, err := ioutil.ReadAll(s1); err != nil || string(got) != "done" {
+				t.Fatalf("v%d: got %q %v", version, got, err)
+			}
+			s1.Close()
+		}
+
+		client.socket.Close()
+		<-client.closed
+		<-server.closed
+	}
+}
+
+func TestRawStreamReset(t *testing.T) {
+	client, server := newConnectionPair(t, 3)
+	defer client.socket.Close()
+
+	s1, err := client.OpenStream(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	io.WriteString(s2, "hello")
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(s1, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	s1.Reset()
+
+	if _, err := s2.Read(buf); err != ErrCancel(s2.StreamId()) {
+		t.Fatalf("expected a cancel, got %v", err)
+	}
+	if _, err := s1.Read(buf); err == nil || err == io.EOF {
+		t.Fatalf("expected an error, got %v", err)
+	}
+
+	client.socket.Close()
+	if _, err := server.AcceptStream(); err != ErrConnectionClosed {
+		t.Fatalf("expected %v, got %v", ErrConnectionClosed, err)
+	}
+}
+
+func TestRawStreamRefused(t *testing.T) {
+	peer, sock := net.Pipe()
+	defer peer.Close()
+
+	go (&Server{}).ServeConn(sock, 3)
+
+	// Servers that never call AcceptStream reset header-less streams
+	// rather than parking them.
+	const last = 2*maxPendingStreams + 1
+	go func() {
+		zip := new(compressor)
+		for id := 1; id <= last; id += 2 {
+			syn := &synStreamFrame{Version: 3, StreamId: id, Raw: true}
+			if syn.WriteFrame(peer, zip) != nil {
+				return
+			}
+		}
+	}()
+
+	for id := 1; id <= last; id += 2 {
+		for {
+			d := readFrame(t, peer)
+			if frameCode(d) != rstStreamCode {
+				continue
+			}
+
+			f, err := parseRstStream(d)
+			if err != nil || f.StreamId != id || f.Reason != rstProtocolError {
+				t.Fatalf("expected stream %d to be reset with PROTOCOL_ERROR, got %+v %v", id, f, err)
+			}
+			break
+		}
+	}
+}
+
+func TestRawStreamConcurrentClose(t *testing.T) {
+	peer, s := openRawPeer(t, func(*Connection) {})
+
+	// The peer never opens up the window, so the writes end up blocked
+	fins := make(chan int)
+	go func() {
+		n := 0
+		h := make([]byte, 8)
+		for {
+			if _, err := io.ReadFull(peer, h); err != nil {
+				fins <- n
+				return
+			}
+			if _, err := io.ReadFull(peer, make([]byte, fromBig32(h[4:])&0xFFFFFF)); err != nil {
+				fins <- n
+				return
+			}
+			if h[0]&0x80 == 0 && h[4]&finishedFlag != 0 {
+				n++
+			}
+		}
+	}()
+
+	written := make(chan error)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			if _, err := s.Write(buf); err != nil {
+				written <- err
+				return
+			}
+		}
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	closed := make(chan bool)
+	for i := 0; i < 2; i++ {
+		go func() {
+			s.Close()
+			closed <- true
+		}()
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case err := <-written:
+			if err != ErrWriteAfterClose {
+				t.Fatalf("expected the write to fail with %v, got %v", ErrWriteAfterClose, err)
+			}
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("close didn't unblock the write")
+		}
+	}
+
+	peer.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n := <-fins; n != 1 {
+		t.Fatalf("expected one FIN, got %d", n)
+	}
+}
@@ -1,7 +1,9 @@
 package spdy
 
 import (
+	"bufio"
 	"bytes"
+	"compress/zlib"
 	"crypto/rand"
 	"crypto/tls"
 	"fmt"
@@ -12,15 +14,118 @@ import (
 	"time"
 )
 
-func serverConnectThread(sock net.Conn, handler http.Handler, fallback chan net.Conn) {
+// Server holds the settings for the SPDY connections that it serves. The
+// package level ListenAndServe, etc use a Server with only the Handler set.
+type Server struct {
+	// Handler handles requests, http.DefaultServeMux is used if nil.
+	Handler http.Handler
+
+	// ReceiveWindow is the initial per stream flow control window
+	// announced to clients. Zero uses the SPDY default of 64KB.
+	ReceiveWindow int
+
+	// AutoTuneBudget enables stream receive window auto-tuning, see
+	// Connection.SetAutoTuneBudget.
+	AutoTuneBudget int
+
+	// MaxControlFrameSize limits the control frames accepted from
+	// clients, see Connection.SetMaxControlFrameSize. Zero uses
+	// DefaultMaxControlFrameSize.
+	MaxControlFrameSize int
+
+	// HeaderCompression is the zlib compression level for the headers
+	// sent to clients. Zero uses the default of zlib.BestCompression, so
+	// set DisableHeaderCompression for zlib.NoCompression.
+	HeaderCompression int
+
+	// DisableHeaderCompression sends the headers uncompressed, in zlib
+	// stored blocks. It takes precedence over HeaderCompression.
+	DisableHeaderCompression bool
+
+	// SensitiveHeaders are kept out of the header compression context,
+	// see Connection.SetSensitiveHeaders. Nil uses
+	// DefaultSensitiveHeaders.
+	SensitiveHeaders []string
+
+	// RateLimits limits the frames accepted from clients, see
+	// Connection.SetRateLimits. Nil uses DefaultRateLimits.
+	RateLimits *RateLimits
+
+	// Timeouts limits how long clients may take over requests, see
+	// Connection.SetTimeouts. Header also limits the TLS handshake and
+	// the wait for the first bytes of a cleartext connection. HTTP/1.1
+	// fallback clients get Header as the http.Server ReadHeaderTimeout
+	// and Write as its WriteTimeout, which limits the whole response
+	// rather than each blocked write.
+	Timeouts Timeouts
+}
+
+func (srv *Server) handler() http.Handler {
+	if srv.Handler == nil {
+		return http.DefaultServeMux
+	}
+	return srv.Handler
+}
+
+// fallbackServer returns the HTTP server for clients that don't speak SPDY.
+func (srv *Server) fallbackServer(addr string) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           srv.handler(),
+		ReadHeaderTimeout: srv.Timeouts.Header,
+		WriteTimeout:      srv.Timeouts.Write,
+	}
+}
+
+// ServeConn serves SPDY of the given version on sock, which has already
+// been accepted and negotiated. This can be used with
+// http.Server.TLSNextProto.
+func (srv *Server) ServeConn(sock net.Conn, version int) {
+	srv.newConnection(sock, version).Run()
+}
+
+func (srv *Server) newConnection(sock net.Conn, version int) *Connection {
+	c := NewConnection(sock, srv.handler(), version, true)
+	if srv.ReceiveWindow > 0 {
+		c.SetReceiveWindow(srv.ReceiveWindow)
+	}
+	c.SetAutoTuneBudget(srv.AutoTuneBudget)
+	if srv.MaxControlFrameSize > 0 {
+		c.SetMaxControlFrameSize(srv.MaxControlFrameSize)
+	}
+	if srv.DisableHeaderCompression {
+		c.SetHeaderCompression(zlib.NoCompression)
+	} else if srv.HeaderCompression != 0 {
+		c.SetHeaderCompression(srv.HeaderCompression)
+	}
+	if srv.SensitiveHeaders != nil {
+		c.SetSensitiveHeaders(srv.SensitiveHeaders)
+	}
+	if srv.RateLimits != nil {
+		c.SetRateLimits(*srv.RateLimits)
+	}
+	c.SetTimeouts(srv.Timeouts)
+	return c
+}
+
+func (srv *Server) connectThread(sock net.Conn, fallback chan net.Conn) {
 	addr := sock.RemoteAddr()
 
 	version := 2
 
+	// Until we know what the client is speaking none of the connection's
+	// timeouts apply, so limit the handshake and sniff to Timeouts.Header
+	// to stop clients that send nothing from holding on to the socket.
+	if srv.Timeouts.Header > 0 {
+		sock.SetDeadline(time.Now().Add(srv.Timeouts.Header))
+	}
+
 	if t, ok := sock.(*tls.Conn); ok {
 		if err := t.Handshake(); err != nil {
+			sock.Close()
 			return
 		}
+		sock.SetDeadline(time.Time{})
 
 		s := t.ConnectionState()
 
@@ -45,6 +150,29 @@ func serverConnectThread(sock net.Conn, handler http.Handler, fallback chan net.
 		default:
 			panic("spdy-internal: unexpected negotiated protocol")
 		}
+
+	} else {
+		// Without TLS we have to look at the first frame to figure
+		// out whether the client is speaking SPDY or HTTP.
+		br := bufio.NewReader(sock)
+		d, err := br.Peek(8)
+		if err != nil {
+			// Neither a SPDY frame header nor an HTTP request line
+			// fits in fewer than 8 bytes.
+			sock.Close()
+			return
+		}
+		sock.SetDeadline(time.Time{})
+		sock = &peekedConn{sock, br}
+
+		if version = sniffVersion(d); version == 0 {
+			if fallback != nil {
+				fallback <- sock
+			} else {
+				sock.Close()
+			}
+			return
+		}
 	}
 
 	defer func() {
@@ -56,17 +184,43 @@ func serverConnectThread(sock net.Conn, handler http.Handler, fallback chan net.
 		}
 	}()
 
-	c := NewConnection(sock, handler, version, true)
-	c.Run()
+	srv.ServeConn(sock, version)
 }
 
-// serve runs the server accept loop
-func serve(listener net.Listener, handler http.Handler, fallback chan net.Conn) error {
+// sniffVersion returns the SPDY version if d starts with a SPDY/2 or SPDY/3
+// control frame header. Clients may start with any control frame, eg our own
+// start with a PING when auto-tuning windows. HTTP/1.1 requests never start
+// with the control bit set. Otherwise it returns 0.
+func sniffVersion(d []byte) int {
+	if len(d) < 8 || d[0]&0x80 == 0 {
+		return 0
+	}
 
-	if handler == nil {
-		handler = http.DefaultServeMux
+	version := int(fromBig16(d) & 0x7FFF)
+	if version != 2 && version != 3 {
+		return 0
 	}
 
+	if code := fromBig32(d) & 0x8000FFFF; code < synStreamCode || code > windowUpdateCode {
+		return 0
+	}
+
+	return version
+}
+
+// peekedConn is a socket where some of the data has already been read into
+// a buffered reader.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// serve runs the server accept loop
+func (srv *Server) serve(listener net.Listener, fallback chan net.Conn) error {
 	for {
 		sock, err := listener.Accept()
 		if err != nil {
@@ -77,16 +231,23 @@ func serve(listener net.Listener, handler http.Handler, fallback chan net.Conn)
 
 		// Do the TLS negotation on a seperate thread to avoid
 		// blocking the accept loop
-		go serverConnectThread(sock, handler, fallback)
+		go srv.connectThread(sock, fallback)
 	}
 
 	panic("unreachable")
 }
 
-// ListenAndServe listens for unencrypted SPDY connections on addr. Because it
-// does not use TLS/SSL of this it can't use the next protocol negotation in
-// TLS to fall back on standard HTTP.
+// ListenAndServe listens for unencrypted SPDY or HTTP connections on addr.
+// As there is no TLS next protocol negotiation, the first bytes sent by the
+// client are used to decide whether to speak SPDY or to fall back on standard
+// HTTP.
 func ListenAndServe(addr string, handler http.Handler) error {
+	return (&Server{Handler: handler}).ListenAndServe(addr)
+}
+
+// ListenAndServe is like the package level ListenAndServe using the
+// server's settings.
+func (srv *Server) ListenAndServe(addr string) error {
 	if addr == "" {
 		addr = ":http"
 	}
@@ -94,19 +255,46 @@ func ListenAndServe(addr string, handler http.Handler) error {
 	if err != nil {
 		return err
 	}
-	return serve(conn, handler, nil)
+	return srv.Serve(conn)
+}
+
+// Serve is like ListenAndServe but serves connections accepted on listener.
+func Serve(listener net.Listener, handler http.Handler) error {
+	return (&Server{Handler: handler}).Serve(listener)
+}
+
+// Serve serves connections accepted on listener using the server's
+// settings.
+func (srv *Server) Serve(listener net.Listener) error {
+	fallback := &httpsListener{
+		error:  make(chan error),
+		accept: make(chan net.Conn),
+		addr:   listener.Addr(),
+		name:   "http",
+	}
+
+	go srv.fallbackServer(listener.Addr().String()).Serve(fallback)
+
+	err := srv.serve(listener, fallback.accept)
+	fallback.error <- err
+	return err
 }
 
 // ListenAndServeTLS listens for encrpyted SPDY or HTTPS connections on addr.
 // It uses the TLS next negotation protocol to fallback on standard https.
 func ListenAndServeTLS(addr string, certFile string, keyFile string, handler http.Handler) error {
+	return (&Server{Handler: handler}).ListenAndServeTLS(addr, certFile, keyFile)
+}
+
+// ListenAndServeTLS is like the package level ListenAndServeTLS using the
+// server's settings.
+func (srv *Server) ListenAndServeTLS(addr string, certFile string, keyFile string) error {
 	if addr == "" {
 		addr = ":https"
 	}
 	cfg := &tls.Config{
 		Rand:         rand.Reader,
 		Time:         time.Now,
-		NextProtos:   []string{"spdy/3", "spdy/2", "http/1.1"},
 		Certificates: make([]tls.Certificate, 1),
 	}
 
@@ -121,29 +309,49 @@ func ListenAndServeTLS(addr string, certFile string, keyFile string, handler htt
 		return err
 	}
 
-	tlsListener := tls.NewListener(conn, cfg)
+	return srv.ServeTLS(conn, cfg)
+}
+
+// ServeTLS is like ListenAndServeTLS but serves connections accepted on
+// listener using cfg for the TLS setup. This allows the caller to setup
+// client certificate verification, etc. The next protocols in cfg are
+// overwritten.
+func ServeTLS(listener net.Listener, cfg *tls.Config, handler http.Handler) error {
+	return (&Server{Handler: handler}).ServeTLS(listener, cfg)
+}
+
+// ServeTLS is like the package level ServeTLS using the server's settings.
+func (srv *Server) ServeTLS(listener net.Listener, cfg *tls.Config) error {
+	cfg = cfg.Clone()
+	cfg.NextProtos = []string{"spdy/3", "spdy/2", "http/1.1"}
+
+	tlsListener := tls.NewListener(listener, cfg)
 
 	fallback := &httpsListener{
 		error:  make(chan error),
 		accept: make(chan net.Conn),
 		addr:   tlsListener.Addr(),
+		name:   "https",
 	}
 
-	go (&http.Server{Addr: addr, Handler: handler}).Serve(fallback)
+	go srv.fallbackServer(listener.Addr().String()).Serve(fallback)
 
-	err = serve(tlsListener, handler, fallback.accept)
+	err := srv.serve(tlsListener, fallback.accept)
 	fallback.error <- err
 	return err
 }
 
-// httpsListener is a fake listener for feeding to the standard HTTPS server.
+// httpsListener is a fake listener for feeding to the standard HTTP(S)
+// server.
 //
 // This is so that we can hand it connections which negotiate https as their
-// protocol through TLS next protocol negotation.
+// protocol through TLS next protocol negotation, or which don't start with a
+// SPDY frame on an unencrypted port.
 type httpsListener struct {
 	error  chan error
 	accept chan net.Conn
 	addr   net.Addr
+	name   string
 }
 
 func (s *httpsListener) Accept() (net.Conn, error) {
@@ -151,7 +359,12 @@ func (s *httpsListener) Accept() (net.Conn, error) {
 	case err := <-s.error:
 		return nil, err
 	case sock := <-s.accept:
-		return &connLogger{sock, "https"}, nil
+		// The standard server only fills in Request.TLS when it is
+		// handed the *tls.Conn itself.
+		if _, ok := sock.(*tls.Conn); ok {
+			return sock, nil
+		}
+		return &connLogger{sock, s.name}, nil
 	}
 	panic("unreachable")
 }
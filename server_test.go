@@ -0,0 +1,388 @@
+package spdy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSniffVersion(t *testing.T) {
+	tests := []struct {
+		data    string
+		version int
+	}{
+		{"\x80\x02\x00\x01\x01\x00\x00\x0a", 2},
+		{"\x80\x03\x00\x01\x00\x00\x00\x0a", 3},
+		{"\x80\x03\x00\x04\x00\x00\x00\x0c", 3},
+		{"\x80\x03\x00\x06\x00\x00\x00\x04", 3}, // PING
+		{"\x80\x03\x00\x0a\x00\x00\x00\x04", 0}, // unknown type
+		{"\x80\x04\x00\x01\x00\x00\x00\x0a", 0},
+		{"\x00\x00\x00\x01\x00\x00\x00\x00", 0}, // DATA
+		{"GET / HTTP/1.1\r\n", 0},
+		{"\x80\x03", 0},
+	}
+
+	for _, test := range tests {
+		if got := sniffVersion([]byte(test.data)); got != test.version {
+			t.Errorf("%q: got version %d, want %d", test.data, got, test.version)
+		}
+	}
+}
+
+func TestServeSniffing(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(Stream); ok {
+			w.Write([]byte("spdy"))
+		} else {
+			w.Write([]byte("http"))
+		}
+	}))
+
+	url := "http://" + l.Addr().String() + "/"
+
+	for _, version := range []int{2, 3} {
+		tr := &Transport{CleartextVersion: version}
+		if got := testGet(t, tr, url); got != "spdy" {
+			t.Fatalf("got %q", got)
+		}
+		if conns := tr.Connections(); len(conns) != 1 || conns[0].Version != version {
+			t.Fatalf("expected a spdy/%d connection, got %+v", version, conns)
+		}
+	}
+
+	// Auto-tuning clients start with a PING rather than SETTINGS
+	tr := &Transport{CleartextVersion: 3, AutoTuneBudget: 1 << 20}
+	if got := testGet(t, tr, url); got != "spdy" {
+		t.Fatalf("got %q", got)
+	}
+
+	if got := testGet(t, &http.Transport{}, url); got != "http" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestHijack(t *testing.T) {
+	deadline := make(chan error, 1)
+
+	srv, tr := newTestServer(t, 3, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" || r.URL.Host != "tunnel.test:443" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("X-Tunnel", "yes")
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		// The handler returning shouldn't finish the stream
+		go func() {
+			defer conn.Close()
+
+			buf := make([]byte, 4)
+			conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+			_, err := conn.Read(buf)
+			deadline <- err
+			conn.SetReadDeadline(time.Time{})
+
+			io.Copy(conn, conn)
+			io.WriteString(conn, "bye")
+		}()
+	}))
+	defer srv.Close()
+
+	req, _ := http.NewRequest("CONNECT", srv.URL, nil)
+	req.Host = "tunnel.test:443"
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Tunnel") != "yes" {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+
+	if err := <-deadline; err != os.ErrDeadlineExceeded {
+		t.Fatalf("expected a deadline error, got %v", err)
+	}
+
+	tunnel := resp.Body.(io.ReadWriteCloser)
+	buf := make([]byte, 4)
+	for _, msg := range []string{"ping", "pong"} {
+		io.WriteString(tunnel, msg)
+		if _, err := io.ReadFull(tunnel, buf); err != nil || string(buf) != msg {
+			t.Fatalf("got %q %v", buf, err)
+		}
+	}
+
+	// Half closing our side should let the server finish up
+	if err := tunnel.(closeWriter).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadAll(tunnel); err != nil || string(data) != "bye" {
+		t.Fatalf("got %q %v", data, err)
+	}
+}
+
+func TestHijackWithoutBody(t *testing.T) {
+	srv, tr := newTestServer(t, 3, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		// The request has already finished, but closing still
+		// finishes the response
+		io.WriteString(conn, "hijacked")
+		conn.Close()
+	}))
+	defer srv.Close()
+
+	done := make(chan string)
+	go func() {
+		done <- testGet(t, tr, srv.URL)
+	}()
+
+	select {
+	case got := <-done:
+		if got != "hijacked" {
+			t.Fatalf("got %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("response wasn't finished")
+	}
+}
+
+func TestServerReceiveWindow(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go (&Server{Handler: echoHandler, ReceiveWindow: 1000}).Serve(l)
+
+	// Both directions are larger than the announced windows
+	tr := &Transport{CleartextVersion: 3, ReceiveWindow: 2000}
+	body := strings.Repeat("x", 100*1024)
+
+	got, err := testPost(tr, "http://"+l.Addr().String()+"/", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "POST / "+body {
+		t.Fatalf("got %d bytes", len(got))
+	}
+}
+
+// timeoutPeer starts a server connection with the given timeouts and has
+// the raw peer send it a POST on stream 1.
+func timeoutPeer(t *testing.T, timeouts Timeouts, h http.HandlerFunc) net.Conn {
+	peer, sock := net.Pipe()
+	t.Cleanup(func() { peer.Close() })
+
+	c := NewConnection(sock, h, 3, true)
+	c.SetTimeouts(timeouts)
+	go c.Run()
+
+	syn := &synStreamFrame{
+		Version:    3,
+		StreamId:   1,
+		URL:        testurl,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Method:     "POST",
+		Header:     http.Header{},
+	}
+	if err := syn.WriteFrame(peer, new(compressor)); err != nil {
+		t.Fatal(err)
+	}
+	return peer
+}
+
+// handlerResult passes on an error from a handler once its context has
+// been cancelled.
+func handlerResult(r *http.Request, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	select {
+	case <-r.Context().Done():
+		return err
+	case <-time.After(time.Second):
+		return errors.New("handler context wasn't cancelled")
+	}
+}
+
+func readBody(errs chan error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, err := ioutil.ReadAll(r.Body)
+		errs <- handlerResult(r, err)
+	}
+}
+
+// expectTimeout reads frames from the peer up to stream 1 being reset and
+// then checks that the handler saw the timeout.
+func expectTimeout(t *testing.T, peer net.Conn, errs chan error) {
+	for {
+		d := readFrame(t, peer)
+		if frameCode(d) != rstStreamCode {
+			continue
+		}
+
+		f, err := parseRstStream(d)
+		if err != nil || f.StreamId != 1 || f.Reason != rstCancel {
+			t.Fatalf("expected stream 1 to be cancelled, got %+v %v", f, err)
+		}
+		break
+	}
+
+	if err := <-errs; err != ErrStreamTimeout(1) {
+		t.Fatalf("expected the handler to time out, got %v", err)
+	}
+}
+
+func TestHeaderTimeout(t *testing.T) {
+	peer, sock := net.Pipe()
+	defer peer.Close()
+
+	c := NewConnection(sock, nil, 3, true)
+	c.SetTimeouts(Timeouts{Header: 50 * time.Millisecond})
+	go c.Run()
+
+	// Idle connections don't time out
+	time.Sleep(100 * time.Millisecond)
+	(&pingFrame{Version: 3, Id: 1}).WriteFrame(peer, nil)
+	if _, err := parsePing(readFrame(t, peer)); err != nil {
+		t.Fatal(err)
+	}
+
+	// but frames that stop part way through do
+	syn := &synStreamFrame{Version: 3, StreamId: 1, URL: testurl, Method: "GET"}
+	buf := new(bytes.Buffer)
+	syn.WriteFrame(buf, new(compressor))
+	peer.Write(buf.Bytes()[:12])
+
+	if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the connection to close, got %v", err)
+	}
+}
+
+func TestSniffTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	srv := &Server{Timeouts: Timeouts{Header: 50 * time.Millisecond}}
+	go srv.Serve(l)
+
+	dial := func(data string) net.Conn {
+		peer, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer.SetDeadline(time.Now().Add(5 * time.Second))
+		peer.Write([]byte(data))
+		return peer
+	}
+
+	// Clients that stall before we know whether they're speaking SPDY or
+	// HTTP, and HTTP clients that stall part way through the headers, are
+	// disconnected.
+	for _, data := range []string{"", "\x80\x03", "GET / HTTP/1.1\r\n"} {
+		peer := dial(data)
+		if _, err := ioutil.ReadAll(peer); err != nil {
+			t.Errorf("%q: expected the connection to close, got %v", data, err)
+		}
+		peer.Close()
+	}
+
+	// Sniffed SPDY connections don't keep the deadline
+	peer := dial("")
+	defer peer.Close()
+	(&pingFrame{Version: 3, Id: 1}).WriteFrame(peer, nil)
+	time.Sleep(100 * time.Millisecond)
+	(&pingFrame{Version: 3, Id: 3}).WriteFrame(peer, nil)
+	for _, id := range []uint32{1, 3} {
+		if f, err := parsePing(readFrame(t, peer)); err != nil || f.Id != id {
+			t.Fatalf("expected ping %d, got %+v %v", id, f, err)
+		}
+	}
+}
+
+func TestDataTimeout(t *testing.T) {
+	errs := make(chan error, 1)
+	peer := timeoutPeer(t, Timeouts{Data: 50 * time.Millisecond}, readBody(errs))
+
+	(&dataFrame{StreamId: 1, Data: []byte("hello")}).WriteFrame(peer, nil)
+	expectTimeout(t, peer, errs)
+}
+
+func TestDataTimeoutWaitsForHandler(t *testing.T) {
+	errs := make(chan error, 1)
+	peer := timeoutPeer(t, Timeouts{Data: 50 * time.Millisecond}, func(w http.ResponseWriter, r *http.Request) {
+		// The remote can't send while we aren't reading
+		time.Sleep(200 * time.Millisecond)
+		readBody(errs)(w, r)
+	})
+
+	(&dataFrame{StreamId: 1, Data: make([]byte, defaultWindow)}).WriteFrame(peer, nil)
+
+	if _, err := parseWindowUpdate(readFrame(t, peer)); err != nil {
+		t.Fatal(err)
+	}
+	(&dataFrame{StreamId: 1, Finished: true}).WriteFrame(peer, nil)
+
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBodyTimeout(t *testing.T) {
+	errs := make(chan error, 1)
+	peer := timeoutPeer(t, Timeouts{Data: 100 * time.Millisecond, Body: 150 * time.Millisecond}, readBody(errs))
+
+	// Trickle the body in faster than the data timeout
+	go func() {
+		for {
+			if (&dataFrame{StreamId: 1, Data: []byte("x")}).WriteFrame(peer, nil) != nil {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+
+	expectTimeout(t, peer, errs)
+}
+
+func TestWriteTimeout(t *testing.T) {
+	errs := make(chan error, 1)
+	peer := timeoutPeer(t, Timeouts{Write: 100 * time.Millisecond}, func(w http.ResponseWriter, r *http.Request) {
+		// More than the window, which the remote never reopens
+		_, err := w.Write(make([]byte, 2*defaultWindow))
+		errs <- handlerResult(r, err)
+	})
+
+	expectTimeout(t, peer, errs)
+}
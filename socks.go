@@ -0,0 +1,169 @@
+package spdy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+)
+
+const (
+	socksVersion = 5
+
+	socksNoAuth       = 0
+	socksPasswordAuth = 2
+	socksNoAcceptable = 0xFF
+
+	socksConnect = 1
+
+	socksIPv4   = 1
+	socksDomain = 3
+	socksIPv6   = 4
+)
+
+var ErrSocksAuth = errors.New("spdy: socks5 proxy authentication failed")
+
+// ErrSocksReply is returned when a SOCKS5 proxy refuses a connect request.
+// The value is the reply code sent by the proxy.
+type ErrSocksReply int
+
+func (s ErrSocksReply) Error() string {
+	return fmt.Sprintf("spdy: socks5 proxy connect failed with code %d", int(s))
+}
+
+// socksConnectTo runs the SOCKS5 handshake on conn asking the proxy to
+// connect to addr. Domain names are sent to the proxy unresolved so that the
+// lookup is done remotely. If the proxy URL has user info then username and
+// password authentication is offered.
+func socksConnectTo(conn net.Conn, proxy *url.URL, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 0xFFFF {
+		return fmt.Errorf("spdy: invalid port in %s", addr)
+	}
+
+	// Method selection
+	methods := []byte{socksVersion, 1, socksNoAuth}
+	if proxy.User != nil {
+		methods = []byte{socksVersion, 2, socksNoAuth, socksPasswordAuth}
+	}
+
+	if _, err := conn.Write(methods); err != nil {
+		return err
+	}
+
+	var h [2]byte
+	if _, err := io.ReadFull(conn, h[:]); err != nil {
+		return err
+	}
+
+	if h[0] != socksVersion {
+		return ErrParse(h[:])
+	}
+
+	switch h[1] {
+	case socksNoAuth:
+	case socksPasswordAuth:
+		if proxy.User == nil {
+			return ErrSocksAuth
+		}
+		if err := socksPasswordLogin(conn, proxy.User); err != nil {
+			return err
+		}
+	default:
+		return ErrSocksAuth
+	}
+
+	// Connect request
+	req := []byte{socksVersion, socksConnect, 0}
+
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("spdy: host name too long %s", host)
+		}
+		req = append(req, socksDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socksIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socksIPv6)
+		req = append(req, ip.To16()...)
+	}
+
+	req = append(req, byte(port>>8), byte(port))
+
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// Reply, we don't care about the bound address but we have to
+	// consume it.
+	var reply [4]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+
+	if reply[0] != socksVersion {
+		return ErrParse(reply[:])
+	}
+
+	if reply[1] != 0 {
+		return ErrSocksReply(reply[1])
+	}
+
+	var skip int
+	switch reply[3] {
+	case socksIPv4:
+		skip = net.IPv4len + 2
+	case socksIPv6:
+		skip = net.IPv6len + 2
+	case socksDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return err
+		}
+		skip = int(n[0]) + 2
+	default:
+		return ErrParse(reply[:])
+	}
+
+	_, err = io.ReadFull(conn, make([]byte, skip))
+	return err
+}
+
+// socksPasswordLogin runs the RFC 1929 username/password sub-negotiation.
+func socksPasswordLogin(conn net.Conn, user *url.Userinfo) error {
+	name := user.Username()
+	pass, _ := user.Password()
+
+	if len(name) > 255 || len(pass) > 255 {
+		return ErrSocksAuth
+	}
+
+	req := []byte{1, byte(len(name))}
+	req = append(req, name...)
+	req = append(req, byte(len(pass)))
+	req = append(req, pass...)
+
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+
+	if reply[1] != 0 {
+		return ErrSocksAuth
+	}
+
+	return nil
+}
@@ -2,12 +2,16 @@ package spdy
 
 import (
 	"bufio"
-	"bytes"
 	"compress/zlib"
+	"context"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"os"
+	"strings"
 	"sync"
+	"time"
 )
 
 const (
@@ -16,6 +20,8 @@ const (
 	defaultWindow     = 64 * 1024
 	maxStreamId       = 0x7FFFFFFF
 	maxDataPacketSize = 4 * 1024
+	txBufferSize      = 64 * 1024
+	maxDispatchQueue  = 64 // received frames waiting for the dispatch thread
 )
 
 type stream struct {
@@ -25,36 +31,71 @@ type stream struct {
 	connection  *Connection
 	request     *http.Request
 	isRecipient bool
+	raw         bool        // opened with OpenStream rather than a request
+	rawHeader   http.Header // SYN_STREAM headers of a raw stream
 
 	// Receive data, shared between dispatch and rx thread, data must be
 	// accessed with a lock and the condition variable is used to signal
 	// updates
-	rxLock       sync.Mutex
-	rxCond       *sync.Cond
-	rxResponse   *http.Response
-	rxBuffer     bytes.Buffer
-	rxCompressed bool // whether the data is transparently compressed or not
-	rxFinished   bool
-	rxError      error
+	rxLock        sync.Mutex
+	rxCond        sync.Cond
+	rxResponse    *http.Response
+	rxBuffer      rxQueue
+	rxCompressed  bool // whether the data is transparently compressed or not
+	rxFinished    bool
+	rxError       error
+	rxContinued   bool // a 100 Continue was received
+	rxWindow      int  // how much more data the remote may send (v3)
+	rxConsumed    int  // data read but not yet given back to the window
+	rxWindowSize  int  // current window size, grows with auto-tuning
+	rxGrown       int  // how much of the connection's budget is used
+	rxEpoch       time.Time
+	rxEpochRead   int // data read since rxEpoch
+	rxUpdateTimer *time.Timer
+	rxUpdateArmed bool
+	rxDeadline    time.Time
+	rxTimer       *time.Timer
 
 	// Receive data only used by the dispatch thread
 	rxHaveData bool
-
-	// Receive thread data, only accessed by the rx thread
-	rxClosed bool
-	rxReader io.Reader
+	rxContinue chan bool // closed to start an Expect: 100-continue body
+
+	// Server timeouts for requests we handle, see Connection.SetTimeouts.
+	// Set up before the handler starts and then only changed by the
+	// dispatch thread.
+	timeoutTimer *time.Timer
+	rxStarted    time.Time
+	rxLastData   time.Time
+	rxHeldUp     bool               // the remote was waiting on the handler
+	cancel       context.CancelFunc // cancels the handler's context
+
+	// Receive thread data, only accessed by the rx thread apart from
+	// rxClosed and connClosed, which Close may set from another goroutine
+	// and so are guarded by rxLock
+	rxClosed   bool
+	connClosed bool // streamConn.Close has been called
+	rxReader   io.Reader
 
 	// Transmit data, shared between dispatch and tx thread
-	txLock   sync.Mutex
-	txCond   *sync.Cond
-	txWindow int
-	txError  error
+	txLock     sync.Mutex
+	txCond     sync.Cond
+	txWindow   int
+	txError    error
+	txContinue bool // a 100 Continue is owed on the first request body read
+	txDeadline time.Time
+	txTimer    *time.Timer
+	txStalled  time.Time // when a blocked write started waiting
+	txHijacked bool      // no more server timeouts once hijacked
+	txAborted  bool      // streamConn.Close fails writes waiting on the window
 
 	// channel that is closed when txError is set to wake up the tx thread
 	// if it is blocked on sending to the connection send thread
 	txErrorChannel chan bool
 
-	// Transmit data, only accessed by the tx thread
+	// Transmit data, only accessed by the tx thread. A streamConn may be
+	// written and closed from different goroutines, so they take txUserLock
+	// to act as the tx thread.
+	txUserLock         sync.Mutex
 	txClosed           bool // streamTxUser.Close has been called
 	txPriority         int
 	txCompressed       bool
@@ -65,6 +106,7 @@ type stream struct {
 	replyHeaderWritten bool
 	replyHeader        http.Header
 	replyStatus        int
+	hijacked           bool
 
 	// Data used by the dispatch thread for handling associated streams. A
 	// stream's associated stream (as specified in that streams
@@ -85,8 +127,26 @@ type RequestExtra struct {
 	Buffered          bool
 	Compressed        bool
 	AssociatedHandler http.Handler
+
+	// ExpectContinueTimeout is how long to hold back the body of a request
+	// with an "Expect: 100-continue" header waiting for the server's
+	// interim response. Zero uses DefaultExpectContinueTimeout and a
+	// negative value sends the body straight away.
+	//
+	// SPDY has no interim responses, so the 100 Continue is sent in a
+	// HEADERS frame before the SYN_REPLY. Other implementations treat that
+	// as a protocol error, so servers only send it to clients that say
+	// they accept it with the continueHeader. Against other servers the
+	// body is always held back for the whole timeout.
+	ExpectContinueTimeout time.Duration
 }
 
+const DefaultExpectContinueTimeout = time.Second
+
+// continueHeader is added to requests by clients that accept a 100 Continue
+// in a HEADERS frame before the SYN_REPLY.
+const continueHeader = "X-Spdy-Interim-Continue"
+
 type Stream interface {
 	http.ResponseWriter
 	http.Flusher
@@ -116,18 +176,30 @@ type streamRxUser stream
 // Seperate type so we can do transparent decompression
 type streamRxIn stream
 
+// Given to the user as a net.Conn when a handler hijacks the stream, as the
+// response body of a CONNECT request without a body so that the tunnel can
+// be written to, and behind RawStream. Writes aren't buffered, and the read
+// and write deadlines cover waiting for data and for the flow control
+// window.
+type streamConn stream
+
+var _ http.Hijacker = (*streamTxUser)(nil)
+var _ net.Conn = (*streamConn)(nil)
+
 func (c *Connection) newStream(req *http.Request, txFinished bool, extra *RequestExtra) *stream {
 	s := new(stream)
 	s.connection = c
 	s.request = req
 	s.isRecipient = false
 
-	s.rxCond = sync.NewCond(&s.rxLock)
+	s.rxCond.L = &s.rxLock
+	s.rxWindow = c.rxWindow
+	s.rxWindowSize = c.rxWindow
 	s.rxFinished = extra.Unidirectional
 	s.rxClosed = extra.Unidirectional
 
-	s.txCond = sync.NewCond(&s.txLock)
-	s.txWindow = defaultWindow
+	s.txCond.L = &s.txLock
+	s.txWindow = defaultWindow // set from the remote's SETTINGS once registered
 
 	s.txErrorChannel = make(chan bool)
 
@@ -144,6 +216,10 @@ func (s *streamRxIn) Read(buf []byte) (int, error) {
 	s.rxLock.Lock()
 
 	for !s.rxFinished && s.rxBuffer.Len() == 0 && s.rxError == nil {
+		if !s.rxDeadline.IsZero() && !time.Now().Before(s.rxDeadline) {
+			s.rxLock.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
 		s.rxCond.Wait()
 	}
 
@@ -152,21 +228,119 @@ func (s *streamRxIn) Read(buf []byte) (int, error) {
 		return 0, s.rxError
 	}
 
-	rxFinished := s.rxFinished
 	n, err := s.rxBuffer.Read(buf)
+
+	delta := 0
+	if !s.rxFinished && s.connection.version >= 3 && n > 0 {
+		s.rxConsumed += n
+		delta = (*stream)(s).takeWindowUpdate()
+	}
 	s.rxLock.Unlock()
 
+	if delta > 0 {
+		(*stream)(s).sendWindowUpdate(delta)
+	}
+
+	return n, err
+}
+
+// takeWindowUpdate returns how much to reopen the window by once enough data
+// has been read, otherwise it makes sure that a timer will send the update
+// later. Updates are coalesced so that bulk transfers don't send one per
+// read. The rxLock must be held.
+func (s *stream) takeWindowUpdate() int {
 	c := s.connection
-	// TODO(james) reduce how often we are sending window updates
-	if !rxFinished && c.version >= 3 && n > 0 {
-		c.sendWindowUpdate <- &windowUpdateFrame{
-			Version:     c.version,
-			StreamId:    s.streamId,
-			WindowDelta: n,
+
+	if s.rxConsumed < c.rxUpdateThreshold(s.rxWindowSize) {
+		if !s.rxUpdateArmed && c.rxUpdateDelay >= 0 {
+			s.rxUpdateArmed = true
+			if s.rxUpdateTimer == nil {
+				s.rxUpdateTimer = time.AfterFunc(c.rxUpdateDelay, s.flushWindowUpdate)
+			} else {
+				s.rxUpdateTimer.Reset(c.rxUpdateDelay)
+			}
 		}
+		return 0
 	}
 
-	return n, err
+	if s.rxUpdateArmed {
+		s.rxUpdateTimer.Stop()
+		s.rxUpdateArmed = false
+	}
+
+	return s.reopenWindow()
+}
+
+// reopenWindow gives the data that has been read back to the window along
+// with any growth from auto-tuning. The rxLock must be held.
+func (s *stream) reopenWindow() int {
+	delta := s.rxConsumed + s.growWindow()
+	s.rxConsumed = 0
+	s.rxWindow += delta
+	return delta
+}
+
+// growWindow auto-tunes the window size if the connection has a budget for
+// it. If the user read a whole window's worth of data in under two round
+// trips then the remote was probably held up waiting for WINDOW_UPDATEs, so
+// the window is doubled as far as the budget allows. It returns the
+// increase. The rxLock must be held.
+func (s *stream) growWindow() int {
+	c := s.connection
+	if c.rxBudget <= 0 {
+		return 0
+	}
+
+	now := time.Now()
+	if s.rxEpoch.IsZero() {
+		s.rxEpoch = now
+	}
+
+	s.rxEpochRead += s.rxConsumed
+	if s.rxEpochRead < s.rxWindowSize {
+		return 0
+	}
+
+	elapsed := now.Sub(s.rxEpoch)
+	s.rxEpoch = now
+	s.rxEpochRead = 0
+
+	rtt := c.roundTripTime()
+	if rtt == 0 || elapsed >= 2*rtt {
+		return 0
+	}
+
+	grow := c.reserveWindow(s.rxWindowSize)
+	s.rxWindowSize += grow
+	s.rxGrown += grow
+	return grow
+}
+
+// flushWindowUpdate sends the update held back by takeWindowUpdate.
+func (s *stream) flushWindowUpdate() {
+	s.rxLock.Lock()
+	s.rxUpdateArmed = false
+	delta := 0
+	if !s.rxFinished && s.rxError == nil {
+		delta = s.reopenWindow()
+	}
+	s.rxLock.Unlock()
+
+	if delta > 0 {
+		s.sendWindowUpdate(delta)
+	}
+}
+
+func (s *stream) sendWindowUpdate(delta int) {
+	c := s.connection
+	select {
+	case c.sendWindowUpdate <- &windowUpdateFrame{
+		Version:     c.version,
+		StreamId:    s.streamId,
+		WindowDelta: delta,
+	}:
+	case <-c.closed:
+	}
 }
 
 // Read reads request/response data.
@@ -179,6 +353,8 @@ func (s *streamRxIn) Read(buf []byte) (int, error) {
 // getting a SPDY RST_STREAM (equivalent of an abort).
 func (s *streamRxUser) Read(buf []byte) (n int, err error) {
 	if s.rxReader == nil {
+		(*stream)(s).sendContinueIfNeeded()
+
 		// Do a zero length read so we can wait for some data to
 		// arrive, so we can tell if its compressed or not.
 		if _, err := (*streamRxIn)(s).Read([]byte{}); err != nil {
@@ -203,16 +379,27 @@ func (s *streamRxUser) Read(buf []byte) (n int, err error) {
 // Closes the rx channel
 func (s *streamRxUser) Close() error {
 	// We don't care about recipients closing the request rx early
-	if s.isRecipient || s.rxClosed {
+	if s.isRecipient {
 		return nil
 	}
 
+	// Don't hold rxLock whilst waiting on the dispatch thread as it may
+	// be trying to deliver data to us.
 	s.rxLock.Lock()
-	defer s.rxLock.Unlock()
-
+	closed := s.rxClosed
 	s.rxClosed = true
-	s.connection.onStreamFinished <- (*stream)(s)
-	return s.rxError
+	err := s.rxError
+	s.rxLock.Unlock()
+
+	if closed {
+		return nil
+	}
+
+	select {
+	case s.connection.onStreamFinished <- (*stream)(s):
+	case <-s.connection.closed:
+	}
+	return err
 }
 
 // PushRequest starts a new pushed request associated with this request.
@@ -402,13 +589,7 @@ func (s *stream) closeTx() {
 		return
 	}
 
-	f := &dataFrame{
-		Finished:   true,
-		Compressed: s.txCompressed,
-		StreamId:   s.streamId,
-	}
-
-	s.sendFrame(f)
+	s.sendFrame(s.newDataFrame(nil, true))
 	s.txFinished = true
 }
 
@@ -442,13 +623,115 @@ func (s *stream) sendFrame(f frame) error {
 		pri = len(c.sendData) - 1
 	}
 
+	select {
+	case c.sendData[pri] <- f:
+		return nil
+	default:
+	}
+
+	// The tx thread is busy, probably as the remote isn't reading
+	s.setStalled(true)
+	defer s.setStalled(false)
+
 	select {
 	case <-s.txErrorChannel:
+		if d, ok := f.(*dataFrame); ok {
+			releaseTxData(d)
+		}
 		return s.txError
 	case c.sendData[pri] <- f:
 	}
 
-	return <-c.dataSent
+	return nil
+}
+
+// setStalled records when the stream starts waiting to send, for
+// Timeouts.Write.
+func (s *stream) setStalled(stalled bool) {
+	if s.timeoutTimer == nil {
+		return
+	}
+
+	s.txLock.Lock()
+	if stalled {
+		s.txStalled = time.Now()
+	} else {
+		s.txStalled = time.Time{}
+	}
+	s.txLock.Unlock()
+}
+
+var txDataPool = sync.Pool{
+	New: func() interface{} {
+		return &dataFrame{buf: new([maxDataPacketSize]byte)}
+	},
+}
+
+// newDataFrame returns a pooled DATA frame with a copy of data, as the
+// frame is encoded some time after the tx thread receives it. The tx thread
+// gives it back with releaseTxData once written.
+func (s *stream) newDataFrame(data []byte, finished bool) *dataFrame {
+	f := txDataPool.Get().(*dataFrame)
+	f.StreamId = s.streamId
+	f.Finished = finished
+	f.Compressed = s.txCompressed
+
+	if len(data) <= len(f.buf) {
+		f.Data = append(f.buf[:0], data...)
+	} else {
+		f.Data = append([]byte(nil), data...)
+	}
+
+	return f
+}
+
+func releaseTxData(f *dataFrame) {
+	f.Data = nil
+	if f.buf != nil {
+		txDataPool.Put(f)
+	}
+}
+
+// expectsContinue returns whether the request body should wait for a 100
+// Continue.
+func expectsContinue(h http.Header) bool {
+	return strings.EqualFold(h.Get("Expect"), "100-continue")
+}
+
+// sendContinueIfNeeded sends a 100 Continue interim response when the handler
+// first reads a request body that the client is holding back. It is sent as
+// a HEADERS frame with a status as SYN_REPLY is reserved for the final
+// response. This is our own extension, so it's only owed to clients that
+// sent the continueHeader.
+func (s *stream) sendContinueIfNeeded() {
+	s.txLock.Lock()
+	send := s.txContinue
+	s.txContinue = false
+	s.txLock.Unlock()
+
+	if !send {
+		return
+	}
+
+	f := &headersFrame{
+		Version:  s.connection.version,
+		StreamId: s.streamId,
+		Status:   "100 Continue",
+	}
+
+	select {
+	case <-s.txErrorChannel:
+	case s.connection.sendControl <- f:
+	}
+}
+
+// wakeContinue lets a request body waiting on a 100 Continue go ahead and
+// decide whether to send. This is only called on the dispatch thread.
+func (s *stream) wakeContinue() {
+	if s.rxContinue != nil {
+		close(s.rxContinue)
+		s.rxContinue = nil
+	}
 }
 
 // sendReply sends the SYN_REPLY frame which contains the response headers.
@@ -458,17 +741,29 @@ func (s *stream) sendReplyIfNeeded(finished bool) error {
 		return nil
 	}
 
+	// Don't go through WriteHeader as that would send the reply itself
 	if !s.replyHeaderWritten {
-		(*streamTxUser)(s).WriteHeader(http.StatusOK)
+		s.replyHeaderWritten = true
+		s.replyStatus = http.StatusOK
 	}
 
+	// Answering before reading the body means that the client doesn't
+	// need to send it.
+	s.txLock.Lock()
+	s.txContinue = false
+	s.txLock.Unlock()
+
 	f := &synReplyFrame{
 		Version:  s.connection.version,
 		Finished: finished,
 		StreamId: s.streamId,
-		Header:   s.replyHeader,
-		Status:   fmt.Sprintf("%d %s", s.replyStatus, http.StatusText(s.replyStatus)),
-		Proto:    "HTTP/1.1",
+		Header:   s.replyHeader.Clone(), // the handler may keep using it
+		Raw:      s.raw,
+	}
+
+	if !s.raw {
+		f.Status = fmt.Sprintf("%d %s", s.replyStatus, http.StatusText(s.replyStatus))
+		f.Proto = "HTTP/1.1"
 	}
 
 	s.replySent = true
@@ -491,7 +786,15 @@ func (s *streamTxOut) amountOfDataToSend(want int) (int, error) {
 	s.txLock.Lock()
 	defer s.txLock.Unlock()
 
-	for s.txWindow <= 0 && s.txError == nil {
+	if s.txWindow <= 0 {
+		s.txStalled = time.Now()
+		defer func() { s.txStalled = time.Time{} }()
+	}
+
+	for s.txWindow <= 0 && s.txError == nil && !s.txAborted {
+		if !s.txDeadline.IsZero() && !time.Now().Before(s.txDeadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
 		s.txCond.Wait()
 	}
 
@@ -499,6 +802,10 @@ func (s *streamTxOut) amountOfDataToSend(want int) (int, error) {
 		return 0, s.txError
 	}
 
+	if s.txWindow <= 0 {
+		return 0, ErrWriteAfterClose
+	}
+
 	if want > s.txWindow {
 		want = s.txWindow
 	}
@@ -535,12 +842,7 @@ func (s *streamTxOut) Write(data []byte) (int, error) {
 			return sent, err
 		}
 
-		f := &dataFrame{
-			Finished:   s.txClosed && sent+tosend == len(data),
-			Compressed: s.txCompressed,
-			Data:       data[sent : sent+tosend],
-			StreamId:   s.streamId,
-		}
+		f := (*stream)(s).newDataFrame(data[sent:sent+tosend], s.txClosed && sent+tosend == len(data))
 
 		s.txFinished = f.Finished
 		if err := (*stream)(s).sendFrame(f); err != nil {
@@ -552,3 +854,164 @@ func (s *streamTxOut) Write(data []byte) (int, error) {
 
 	return sent, nil
 }
+
+// Hijack lets the handler take over the stream as a net.Conn. The reply is
+// sent straight away with the status given to WriteHeader, or 200 by
+// default. Reads then return request data and writes are sent as response
+// data without buffering. CloseWrite finishes the response leaving the
+// request side open, and Close finishes the stream. The stream is no longer
+// finished when the handler returns, and like any net.Conn it may be read,
+// written and closed from different goroutines.
+func (s *streamTxUser) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if s.hijacked {
+		return nil, nil, http.ErrHijacked
+	}
+
+	if s.txClosed {
+		return nil, nil, ErrWriteAfterClose
+	}
+
+	if err := (*stream)(s).sendReplyIfNeeded(false); err != nil {
+		return nil, nil, err
+	}
+
+	s.hijacked = true
+	s.txLock.Lock()
+	s.txHijacked = true
+	s.txLock.Unlock()
+
+	conn := (*streamConn)(s)
+	return conn, bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)), nil
+}
+
+func (s *streamConn) Read(buf []byte) (int, error) {
+	return (*streamRxUser)(s).Read(buf)
+}
+
+// Write sends data straight away, flushing any buffering or compression
+// enabled on the stream.
+func (s *streamConn) Write(data []byte) (int, error) {
+	s.txUserLock.Lock()
+	defer s.txUserLock.Unlock()
+
+	tx := (*streamTxUser)(s)
+	n, err := tx.Write(data)
+	if err != nil {
+		return n, err
+	}
+
+	if s.txWriter != nil {
+		if err := s.txWriter.Flush(); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// CloseWrite sends a FIN leaving the receive side open. It waits for a Write
+// on another goroutine to finish first, and the FIN is only sent once
+// however many times CloseWrite and Close are called.
+func (s *streamConn) CloseWrite() error {
+	s.txUserLock.Lock()
+	defer s.txUserLock.Unlock()
+
+	(*stream)(s).closeTx()
+	return nil
+}
+
+// Close finishes both sides of the stream. Any Write waiting for the remote
+// to open up the flow control window fails with ErrWriteAfterClose, and the
+// FIN is then sent as for CloseWrite. If the remote hasn't finished sending
+// then a client resets the stream, eg on the client side of a CONNECT
+// tunnel.
+func (s *streamConn) Close() error {
+	// rxClosed is already set for requests that came with a FIN, so that
+	// can't tell us whether we've been closed.
+	s.rxLock.Lock()
+	closed := s.connClosed
+	s.connClosed = true
+	s.rxLock.Unlock()
+
+	if closed {
+		return nil
+	}
+
+	s.txLock.Lock()
+	s.txAborted = true
+	s.txCond.Broadcast()
+	s.txLock.Unlock()
+
+	s.CloseWrite()
+
+	if !s.isRecipient {
+		return (*streamRxUser)(s).Close()
+	}
+
+	s.rxLock.Lock()
+	s.rxClosed = true
+	s.rxLock.Unlock()
+
+	select {
+	case s.connection.onStreamFinished <- (*stream)(s):
+	case <-s.connection.closed:
+	}
+	return nil
+}
+
+func (s *streamConn) LocalAddr() net.Addr {
+	return s.connection.socket.LocalAddr()
+}
+
+func (s *streamConn) RemoteAddr() net.Addr {
+	return s.connection.remoteAddr
+}
+
+func (s *streamConn) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	s.SetWriteDeadline(t)
+	return nil
+}
+
+// SetReadDeadline limits the time spent waiting for data from the remote.
+func (s *streamConn) SetReadDeadline(t time.Time) error {
+	s.rxLock.Lock()
+	defer s.rxLock.Unlock()
+
+	s.rxDeadline = t
+	s.rxTimer = resetDeadline(s.rxTimer, t, &s.rxCond)
+	return nil
+}
+
+// SetWriteDeadline limits the time spent waiting for the remote to open up
+// the flow control window. Writes are otherwise only held up by the
+// connection's own tx queue.
+func (s *streamConn) SetWriteDeadline(t time.Time) error {
+	s.txLock.Lock()
+	defer s.txLock.Unlock()
+
+	s.txDeadline = t
+	s.txTimer = resetDeadline(s.txTimer, t, &s.txCond)
+	return nil
+}
+
+// resetDeadline replaces timer with one that wakes up waiters on cond at t so
+// that they can check the deadline. The lock for cond must be held.
+func resetDeadline(timer *time.Timer, t time.Time, cond *sync.Cond) *time.Timer {
+	if timer != nil {
+		timer.Stop()
+	}
+
+	if t.IsZero() {
+		return nil
+	}
+
+	// Also wake up waiters if the deadline has already passed
+	cond.Broadcast()
+
+	return time.AfterFunc(time.Until(t), func() {
+		cond.L.Lock()
+		cond.Broadcast()
+		cond.L.Unlock()
+	})
+}